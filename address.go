@@ -0,0 +1,194 @@
+package flywheel
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// checkAddresses - once the instances run, make sure the elastic IPs are
+// associated to them and the Route53 records point to their new IPs. Fixing
+// either counts as pending, so the status only becomes STARTED once they are
+// correct.
+func (fw *Flywheel) checkAddresses(health map[string]int) error {
+	if len(fw.config.ElasticIPs) == 0 && len(fw.config.Route53) == 0 {
+		return nil
+	}
+
+	instances, err := fw.runningInstances()
+	if err != nil || instances == nil {
+		return err
+	}
+
+	for instanceID, allocationID := range fw.config.ElasticIPs {
+		state, err := fw.checkElasticIP(instanceID, allocationID)
+		if err != nil {
+			return err
+		}
+		health[state] = health[state] + 1
+	}
+
+	for i := range fw.config.Route53 {
+		state, err := fw.checkRecord(&fw.config.Route53[i], instances)
+		if err != nil {
+			return err
+		}
+		health[state] = health[state] + 1
+	}
+	return nil
+}
+
+// runningInstances - the instances by id, or nil unless all of them run
+func (fw *Flywheel) runningInstances() (map[string]*ec2.Instance, error) {
+	resp, err := fw.ec2.DescribeInstances(
+		&ec2.DescribeInstancesInput{
+			InstanceIds: fw.config.AwsInstances(),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make(map[string]*ec2.Instance)
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			if *instance.State.Name != "running" {
+				return nil, nil
+			}
+			instances[*instance.InstanceId] = instance
+		}
+	}
+	return instances, nil
+}
+
+// checkElasticIP - associate an elastic IP to its instance, unless it already is
+func (fw *Flywheel) checkElasticIP(instanceID, allocationID string) (string, error) {
+	resp, err := fw.ec2.DescribeAddresses(
+		&ec2.DescribeAddressesInput{
+			AllocationIds: []*string{aws.String(allocationID)},
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Addresses) > 0 && aws.StringValue(resp.Addresses[0].InstanceId) == instanceID {
+		return "running", nil
+	}
+
+	log.Printf("Associating elastic IP %s to instance %s", allocationID, instanceID)
+	_, err = fw.ec2.AssociateAddress(
+		&ec2.AssociateAddressInput{
+			AllocationId:       aws.String(allocationID),
+			InstanceId:         aws.String(instanceID),
+			AllowReassociation: aws.Bool(true),
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+	return "pending", nil
+}
+
+// checkRecord - point a Route53 A record to the IPs of its instances. The
+// record counts as pending until Route53 has applied the change.
+func (fw *Flywheel) checkRecord(record *Route53Record, instances map[string]*ec2.Instance) (string, error) {
+	var ips []string
+	for _, instanceID := range record.Instances {
+		instance, ok := instances[instanceID]
+		if !ok {
+			continue
+		}
+		ip := instance.PublicIpAddress
+		if record.Private {
+			ip = instance.PrivateIpAddress
+		}
+		if ip == nil {
+			// Public IPs show up shortly after the instance runs
+			return "pending", nil
+		}
+		ips = append(ips, *ip)
+	}
+	sort.Strings(ips)
+
+	name := strings.TrimSuffix(record.Name, ".") + "."
+	resp, err := fw.route53.ListResourceRecordSets(
+		&route53.ListResourceRecordSetsInput{
+			HostedZoneId:    aws.String(record.ZoneID),
+			StartRecordName: aws.String(name),
+			StartRecordType: aws.String(route53.RRTypeA),
+			MaxItems:        aws.String("1"),
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	var current []string
+	for _, set := range resp.ResourceRecordSets {
+		if aws.StringValue(set.Name) == name && aws.StringValue(set.Type) == route53.RRTypeA {
+			for _, value := range set.ResourceRecords {
+				current = append(current, aws.StringValue(value.Value))
+			}
+		}
+	}
+	sort.Strings(current)
+
+	if strings.Join(current, ",") != strings.Join(ips, ",") {
+		log.Printf("Updating Route53 record %s to %v", name, ips)
+		var values []*route53.ResourceRecord
+		for _, ip := range ips {
+			values = append(values, &route53.ResourceRecord{Value: aws.String(ip)})
+		}
+
+		change, err := fw.route53.ChangeResourceRecordSets(
+			&route53.ChangeResourceRecordSetsInput{
+				HostedZoneId: aws.String(record.ZoneID),
+				ChangeBatch: &route53.ChangeBatch{
+					Comment: aws.String("flywheel start"),
+					Changes: []*route53.Change{
+						{
+							Action: aws.String(route53.ChangeActionUpsert),
+							ResourceRecordSet: &route53.ResourceRecordSet{
+								Name:            aws.String(name),
+								Type:            aws.String(route53.RRTypeA),
+								TTL:             aws.Int64(record.TTL),
+								ResourceRecords: values,
+							},
+						},
+					},
+				},
+			},
+		)
+		if err != nil {
+			return "", err
+		}
+		if fw.recordChanges == nil {
+			fw.recordChanges = make(map[string]string)
+		}
+		fw.recordChanges[name] = *change.ChangeInfo.Id
+		return "pending", nil
+	}
+
+	changeID, ok := fw.recordChanges[name]
+	if !ok {
+		return "running", nil
+	}
+
+	change, err := fw.route53.GetChange(
+		&route53.GetChangeInput{
+			Id: aws.String(changeID),
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+	if *change.ChangeInfo.Status != route53.ChangeStatusInsync {
+		return "pending", nil
+	}
+	delete(fw.recordChanges, name)
+	return "running", nil
+}
@@ -1,10 +1,12 @@
 package flywheel
 
 import (
+	"fmt"
 	"log"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
@@ -14,15 +16,32 @@ func (fw *Flywheel) Start() error {
 	fw.lastStarted = time.Now()
 	log.Print("Startup beginning")
 
+	fw.registerTargets()
+
 	var err error
-	err = fw.startInstances()
+	err = fw.resumeRedshift()
 
+	if err == nil {
+		err = fw.restoreElastiCache()
+	}
+	if err == nil {
+		err = fw.startInstances()
+	}
+	if err == nil {
+		err = fw.launchEphemeral()
+	}
 	if err == nil {
 		err = fw.unterminateAutoScaling()
 	}
 	if err == nil {
 		err = fw.startAutoScaling()
 	}
+	if err == nil {
+		err = fw.startStandbyAutoScaling()
+	}
+	if err == nil {
+		err = fw.unparkAutoScaling()
+	}
 
 	if err != nil {
 		log.Printf("Error starting: %v", err)
@@ -31,6 +50,8 @@ func (fw *Flywheel) Start() error {
 
 	fw.ready = false
 	fw.stopAt = time.Now().Add(fw.idleTimeout)
+	fw.lastActive = time.Now()
+	fw.lastScaled = time.Time{}
 	fw.status = STARTING
 	return nil
 }
@@ -40,30 +61,64 @@ func (fw *Flywheel) startInstances() error {
 	if len(fw.config.Instances) == 0 {
 		return nil
 	}
-	log.Printf("Starting instances %v", fw.config.Instances)
-	_, err := fw.ec2.StartInstances(
-		&ec2.StartInstancesInput{
-			InstanceIds: fw.config.AwsInstances(),
-		},
-	)
+	err := fw.restoreInstanceTypes()
+	if err == nil {
+		err = fw.restoreDownsized()
+	}
+	if err == nil {
+		err = fw.restoreVolumes()
+	}
+	if err != nil {
+		return err
+	}
+
+	// Instances waiting for their volumes are started by the healthcheck
+	restoring := fw.restoringVolumes()
+	var instances []string
+	for _, instanceID := range fw.config.Instances {
+		if !restoring[instanceID] {
+			instances = append(instances, instanceID)
+		}
+	}
+	if len(instances) == 0 {
+		return nil
+	}
+
+	log.Printf("Starting instances %v", instances)
+	err = fw.startEC2Instances(aws.StringSlice(instances))
+	if _, ok := err.(*CapacityError); ok && len(fw.config.Fallbacks) > 0 {
+		err = fw.startWithFallback(instances)
+	}
 	return err
 }
 
-// UnterminateAutoScaling - Restore autoscaling group instances
+// UnterminateAutoScaling - Restore autoscaling group instances. Groups go back
+// to the capacity saved when they were terminated, unless a size is configured.
 func (fw *Flywheel) unterminateAutoScaling() error {
 	var err error
 	for groupName, size := range fw.config.AutoScaling.Terminate {
-		log.Printf("Restoring autoscaling group %s to max/min size of %d", groupName, size)
+		capacity, ok := fw.savedCapacity(groupName)
+		if size > 0 {
+			capacity = AutoScalingCapacity{MinSize: size, MaxSize: size, DesiredCapacity: size}
+		} else if !ok {
+			log.Printf("No capacity recorded for autoscaling group %s, skipping restore", groupName)
+			continue
+		}
+
+		log.Printf("Restoring autoscaling group %s to min/max/desired size of %d/%d/%d",
+			groupName, capacity.MinSize, capacity.MaxSize, capacity.DesiredCapacity)
 		_, err = fw.autoscaling.UpdateAutoScalingGroup(
 			&autoscaling.UpdateAutoScalingGroupInput{
-				AutoScalingGroupName: &groupName,
-				MaxSize:              &size,
-				MinSize:              &size,
+				AutoScalingGroupName: aws.String(groupName),
+				MaxSize:              aws.Int64(capacity.MaxSize),
+				MinSize:              aws.Int64(capacity.MinSize),
+				DesiredCapacity:      aws.Int64(capacity.DesiredCapacity),
 			},
 		)
 		if err != nil {
 			return err
 		}
+		fw.forgetCapacity(groupName)
 	}
 	return nil
 }
@@ -91,11 +146,7 @@ func (fw *Flywheel) startAutoScaling() error {
 			instanceIds = append(instanceIds, instance.InstanceId)
 		}
 
-		_, err = fw.ec2.StartInstances(
-			&ec2.StartInstancesInput{
-				InstanceIds: instanceIds,
-			},
-		)
+		err = fw.startEC2Instances(instanceIds)
 		if err != nil {
 			return err
 		}
@@ -107,22 +158,52 @@ func (fw *Flywheel) startAutoScaling() error {
 // Stop all resources managed by the flywheel
 func (fw *Flywheel) Stop() error {
 	fw.lastStopped = time.Now()
+	fw.tunnels.closeAll()
+
+	// Downsized instances are stopped as they are, and get their
+	// original type back on the next start
+	fw.stateLock.Lock()
+	fw.state.Resizing = nil
+	fw.stateLock.Unlock()
 
 	var err error
-	err = fw.stopInstances()
+	err = fw.deregisterTargets()
 
+	if err == nil {
+		err = fw.stopInstances()
+	}
+	if err == nil {
+		err = fw.terminateEphemeral()
+	}
 	if err == nil {
 		err = fw.terminateAutoScaling()
 	}
 	if err == nil {
 		err = fw.stopAutoScaling()
 	}
+	if err == nil {
+		err = fw.standbyAutoScaling()
+	}
+	if err == nil {
+		err = fw.parkAutoScaling()
+	}
+	if err == nil {
+		err = fw.pauseRedshift()
+	}
+	if err == nil {
+		err = fw.snapshotElastiCache()
+	}
 
 	if err != nil {
 		log.Printf("Error stopping: %v", err)
+		// Still running, the healthcheck registers the targets again
+		fw.registerTargets()
 		return err
 	}
 
+	// Only once stopped, the shrunk groups may still need restoring
+	fw.forgetIdleStages()
+
 	fw.ready = false
 	fw.status = STOPPING
 	fw.stopAt = fw.lastStopped
@@ -135,15 +216,90 @@ func (fw *Flywheel) stopInstances() error {
 		return nil
 	}
 	log.Printf("Stopping instances %v", fw.config.Instances)
-	_, err := fw.ec2.StopInstances(
+
+	var hibernate, stop []*string
+	for _, instanceID := range fw.config.Instances {
+		if fw.config.Hibernates(instanceID) {
+			hibernate = append(hibernate, aws.String(instanceID))
+		} else {
+			stop = append(stop, aws.String(instanceID))
+		}
+	}
+
+	err := fw.stopEC2Instances(hibernate, true)
+	if err == nil {
+		err = fw.stopEC2Instances(stop, false)
+	}
+	return err
+}
+
+// stopEC2Instances - stop instances, hibernating them if requested. Instances
+// which can't be hibernated are stopped normally.
+func (fw *Flywheel) stopEC2Instances(instanceIds []*string, hibernate bool) error {
+	var err error
+	if len(instanceIds) > 0 && hibernate {
+		instanceIds, err = fw.hibernateInstances(instanceIds)
+		if err != nil {
+			return err
+		}
+	}
+	if len(instanceIds) == 0 {
+		return nil
+	}
+
+	_, err = fw.ec2.StopInstances(
 		&ec2.StopInstancesInput{
-			InstanceIds: fw.config.AwsInstances(),
+			InstanceIds: instanceIds,
 		},
 	)
 	return err
 }
 
-// Suspend ReplaceUnhealthy in an autoscale group and stop the instances.
+// hibernateInstances - hibernate the instances launched with hibernation
+// enabled, returning the ones that still have to be stopped.
+func (fw *Flywheel) hibernateInstances(instanceIds []*string) ([]*string, error) {
+	resp, err := fw.ec2.DescribeInstances(
+		&ec2.DescribeInstancesInput{
+			InstanceIds: instanceIds,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var hibernate, stop []*string
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.HibernationOptions != nil && aws.BoolValue(instance.HibernationOptions.Configured) {
+				hibernate = append(hibernate, instance.InstanceId)
+			} else {
+				log.Printf("Instance %s was not launched with hibernation enabled, stopping it instead", *instance.InstanceId)
+				stop = append(stop, instance.InstanceId)
+			}
+		}
+	}
+	if len(hibernate) == 0 {
+		return stop, nil
+	}
+
+	log.Printf("Hibernating instances %v", aws.StringValueSlice(hibernate))
+	_, err = fw.ec2.StopInstances(
+		&ec2.StopInstancesInput{
+			InstanceIds: hibernate,
+			Hibernate:   aws.Bool(true),
+		},
+	)
+	if err != nil {
+		// e.g. the instance hasn't finished booting, or its root
+		// volume is too small to hold the RAM
+		log.Printf("Unable to hibernate instances %v, stopping them instead: %v", aws.StringValueSlice(hibernate), err)
+		stop = append(stop, hibernate...)
+	}
+	return stop, nil
+}
+
+// Suspend processes (ReplaceUnhealthy by default) in an autoscale group and
+// stop the instances.
 func (fw *Flywheel) stopAutoScaling() error {
 	for _, groupName := range fw.config.AutoScaling.Stop {
 		log.Printf("Stopping autoscaling group %s", groupName)
@@ -159,16 +315,38 @@ func (fw *Flywheel) stopAutoScaling() error {
 
 		group := resp.AutoScalingGroups[0]
 
-		_, err = fw.autoscaling.SuspendProcesses(
-			&autoscaling.ScalingProcessQuery{
-				AutoScalingGroupName: group.AutoScalingGroupName,
-				ScalingProcesses: []*string{
-					aws.String("ReplaceUnhealthy"),
+		// Only suspend (and later resume) processes that aren't already
+		// suspended, leaving the ones suspended by hand alone.
+		alreadySuspended := make(map[string]bool)
+		for _, process := range group.SuspendedProcesses {
+			alreadySuspended[*process.ProcessName] = true
+		}
+		var processes []string
+		for _, process := range fw.config.AutoScaling.Processes(groupName) {
+			if !alreadySuspended[process] {
+				processes = append(processes, process)
+			}
+		}
+
+		if len(processes) > 0 {
+			log.Printf("Suspending %v in autoscaling group %s", processes, groupName)
+			_, err = fw.autoscaling.SuspendProcesses(
+				&autoscaling.ScalingProcessQuery{
+					AutoScalingGroupName: group.AutoScalingGroupName,
+					ScalingProcesses:     aws.StringSlice(processes),
 				},
-			},
-		)
-		if err != nil {
-			return err
+			)
+			if err != nil {
+				return err
+			}
+
+			fw.stateLock.Lock()
+			if fw.state.SuspendedProcesses == nil {
+				fw.state.SuspendedProcesses = make(map[string][]string)
+			}
+			fw.state.SuspendedProcesses[groupName] = append(fw.state.SuspendedProcesses[groupName], processes...)
+			fw.stateLock.Unlock()
+			fw.persist()
 		}
 
 		instanceIds := []*string{}
@@ -176,11 +354,7 @@ func (fw *Flywheel) stopAutoScaling() error {
 			instanceIds = append(instanceIds, instance.InstanceId)
 		}
 
-		_, err = fw.ec2.StopInstances(
-			&ec2.StopInstancesInput{
-				InstanceIds: instanceIds,
-			},
-		)
+		err = fw.stopEC2Instances(instanceIds, fw.config.Hibernates(groupName))
 		if err != nil {
 			return err
 		}
@@ -189,17 +363,35 @@ func (fw *Flywheel) stopAutoScaling() error {
 	return nil
 }
 
-// Reduce autoscaling min/max instances to 0, causing the instances to be terminated.
+// Reduce autoscaling min/max/desired instances to 0, causing the instances to
+// be terminated. The current capacity is saved so start can restore it.
 func (fw *Flywheel) terminateAutoScaling() error {
-	var err error
 	var zero int64
 	for groupName := range fw.config.AutoScaling.Terminate {
 		log.Printf("Terminating autoscaling group %s", groupName)
+
+		group, err := fw.describeAutoScalingGroup(groupName)
+		if err != nil {
+			return err
+		}
+
+		// Don't overwrite the saved capacity with zeros if the group
+		// was already terminated.
+		if *group.MaxSize > 0 {
+			fw.saveCapacity(group)
+		}
+
+		err = fw.restoreSpot(groupName)
+		if err != nil {
+			return err
+		}
+
 		_, err = fw.autoscaling.UpdateAutoScalingGroup(
 			&autoscaling.UpdateAutoScalingGroupInput{
-				AutoScalingGroupName: &groupName,
+				AutoScalingGroupName: aws.String(groupName),
 				MaxSize:              &zero,
 				MinSize:              &zero,
+				DesiredCapacity:      &zero,
 			},
 		)
 		if err != nil {
@@ -208,3 +400,60 @@ func (fw *Flywheel) terminateAutoScaling() error {
 	}
 	return nil
 }
+
+// describeAutoScalingGroup - retrieve a single autoscaling group by name
+func (fw *Flywheel) describeAutoScalingGroup(groupName string) (*autoscaling.Group, error) {
+	resp, err := fw.autoscaling.DescribeAutoScalingGroups(
+		&autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: []*string{aws.String(groupName)},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.AutoScalingGroups) == 0 {
+		return nil, fmt.Errorf("Autoscaling group %s not found", groupName)
+	}
+	return resp.AutoScalingGroups[0], nil
+}
+
+// saveCapacity - remember the size of an autoscaling group so it can be
+// restored on start
+func (fw *Flywheel) saveCapacity(group *autoscaling.Group) {
+	fw.stateLock.Lock()
+	if fw.state.AutoScaling == nil {
+		fw.state.AutoScaling = make(map[string]AutoScalingCapacity)
+	}
+	fw.state.AutoScaling[*group.AutoScalingGroupName] = AutoScalingCapacity{
+		MinSize:         *group.MinSize,
+		MaxSize:         *group.MaxSize,
+		DesiredCapacity: *group.DesiredCapacity,
+	}
+	fw.stateLock.Unlock()
+	fw.persist()
+}
+
+// savedCapacity - retrieve the size saved by saveCapacity
+func (fw *Flywheel) savedCapacity(groupName string) (AutoScalingCapacity, bool) {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	capacity, ok := fw.state.AutoScaling[groupName]
+	return capacity, ok
+}
+
+// forgetCapacity - drop the saved size once the group has been restored
+func (fw *Flywheel) forgetCapacity(groupName string) {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	delete(fw.state.AutoScaling, groupName)
+}
+
+// isAwsError - check if err is an AWS API error with the given code
+func isAwsError(err error, code string) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == code
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package flywheel
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// BalanceRoundRobin and BalanceLeastConn are the ways to spread requests
+// across discovered backends
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceLeastConn  = "least-connections"
+)
+
+// balancer - picks a backend address for each request
+type balancer struct {
+	lock   sync.Mutex
+	mode   string
+	addrs  []string
+	active map[string]int
+	next   int
+}
+
+// set - replace the backend addresses, keeping the counts of the ones left.
+// Returns whether the addresses changed.
+func (b *balancer) set(addrs []string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if strings.Join(addrs, ",") == strings.Join(b.addrs, ",") {
+		return false
+	}
+
+	active := make(map[string]int, len(addrs))
+	for _, addr := range addrs {
+		active[addr] = b.active[addr]
+	}
+	b.addrs = addrs
+	b.active = active
+	return true
+}
+
+// pick - choose a backend. The returned function has to be called once the
+// request is complete. Returns an empty address without backends.
+func (b *balancer) pick() (string, func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.addrs) == 0 {
+		return "", func() {}
+	}
+
+	var addr string
+	if b.mode == BalanceLeastConn {
+		// Start from the next backend so ties rotate too
+		for i := range b.addrs {
+			candidate := b.addrs[(b.next+i)%len(b.addrs)]
+			if addr == "" || b.active[candidate] < b.active[addr] {
+				addr = candidate
+			}
+		}
+	} else {
+		addr = b.addrs[b.next%len(b.addrs)]
+	}
+	b.next++
+	b.active[addr]++
+
+	return addr, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		// The backend may be gone since
+		if _, ok := b.active[addr]; ok {
+			b.active[addr]--
+		}
+	}
+}
+
+// Backend - retrieve the reverse proxy destination for a request. Without a
+// vhost for the hostname, discovered backends take over from the endpoint.
+// The returned function has to be called once the request is complete.
+func (fw *Flywheel) Backend(hostname string) (string, func()) {
+	if _, ok := fw.config.Vhosts[hostname]; ok || fw.config.Backends.Port == 0 {
+		return fw.ProxyEndpoint(hostname), func() {}
+	}
+	return fw.backends.pick()
+}
+
+// refreshBackends - update the backend addresses from the private IPs of the
+// running instances and in service autoscaling group members with the tag
+func (fw *Flywheel) refreshBackends() error {
+	instanceIds := fw.config.AwsInstances()
+	for _, groupName := range fw.config.Backends.AutoScaling {
+		group, err := fw.describeAutoScalingGroup(groupName)
+		if err != nil {
+			return err
+		}
+		for _, instance := range group.Instances {
+			if *instance.LifecycleState == autoscaling.LifecycleStateInService && *instance.HealthStatus == "Healthy" {
+				instanceIds = append(instanceIds, instance.InstanceId)
+			}
+		}
+	}
+
+	var addrs []string
+	if len(instanceIds) > 0 {
+		filters := []*ec2.Filter{
+			{
+				Name:   aws.String("instance-id"),
+				Values: instanceIds,
+			},
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: []*string{aws.String("running")},
+			},
+		}
+		if tag := fw.config.Backends.Tag; tag != "" {
+			parts := strings.SplitN(tag, "=", 2)
+			if len(parts) == 2 {
+				filters = append(filters, &ec2.Filter{
+					Name:   aws.String("tag:" + parts[0]),
+					Values: []*string{aws.String(parts[1])},
+				})
+			} else {
+				filters = append(filters, &ec2.Filter{
+					Name:   aws.String("tag-key"),
+					Values: []*string{aws.String(tag)},
+				})
+			}
+		}
+
+		resp, err := fw.ec2.DescribeInstances(
+			&ec2.DescribeInstancesInput{
+				Filters: filters,
+			},
+		)
+		if err != nil {
+			return err
+		}
+		for _, reservation := range resp.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.PrivateIpAddress != nil {
+					addrs = append(addrs, fmt.Sprintf("%s:%d", *instance.PrivateIpAddress, fw.config.Backends.Port))
+				}
+			}
+		}
+	}
+	sort.Strings(addrs)
+
+	if fw.backends.set(addrs) {
+		log.Printf("Backends changed to %v", addrs)
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -21,12 +23,14 @@ func main() {
 	var config *flywheel.Config
 
 	var listen string
+	var listenTLS string
 	var configFile string
 	var statusFile string
 	var setuid string
 	var showVersion bool
 
 	flag.StringVar(&listen, "listen", "0.0.0.0:80", "Address and port to listen on")
+	flag.StringVar(&listenTLS, "listen-tls", "", "Address and port to listen on for HTTPS, e.g. 0.0.0.0:443")
 	flag.StringVar(&configFile, "config", "", "Config file to read settings from")
 	flag.StringVar(&statusFile, "status-file", "", "File to save runtime status to")
 	flag.StringVar(&setuid, "setuid", "", "Switch to user after opening socket")
@@ -38,11 +42,48 @@ func main() {
 		return
 	}
 
+	if configFile == "" {
+		log.Fatal("Config file missing. Please run with -help for more info")
+	}
+
+	config, err = flywheel.ReadConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	sock, err := net.Listen("tcp", listen)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	var tlsSock net.Listener
+	var store *flywheel.CertStore
+	if listenTLS != "" {
+		if len(config.TLS.Certificates) == 0 {
+			log.Fatal("No tls certificates configured for --listen-tls")
+		}
+		tlsSock, err = net.Listen("tcp", listenTLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Private keys are usually only readable by root, load them
+		// before dropping privileges too
+		store, err = flywheel.NewCertStore(&config.TLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// TCP listeners are opened before dropping privileges too
+	tcpSocks := make(map[string]net.Listener)
+	for tcpListen := range config.TCP {
+		tcpSocks[tcpListen], err = net.Listen("tcp", tcpListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if setuid != "" {
 		user, err := user.Lookup(setuid)
 		if err != nil {
@@ -59,20 +100,11 @@ func main() {
 		}
 	}
 
-	if configFile == "" {
-		log.Fatal("Config file missing. Please run with -help for more info")
-	}
-
-	config, err = flywheel.ReadConfig(configFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	fw := flywheel.New(config)
 
 	if statusFile != "" {
+		// Spin keeps the status file up to date from now on
 		fw.ReadStatusFile(statusFile)
-		defer fw.WriteStatusFile(statusFile)
 	}
 
 	go fw.Spin()
@@ -81,10 +113,44 @@ func main() {
 
 	http.Handle("/", handler)
 
+	var plain http.Handler
+	var tlsServer *http.Server
+	if tlsSock != nil {
+		go store.Watch(time.Duration(config.TLS.Reload))
+
+		if config.TLS.Redirect {
+			plain = flywheel.RedirectHandler(listenTLS)
+		}
+
+		tlsServer = &http.Server{TLSConfig: store.TLSConfig()}
+		go func() {
+			err := tlsServer.ServeTLS(tlsSock, "", "")
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	for tcpListen, tcpSock := range tcpSocks {
+		proxy := flywheel.NewTCPProxy(handler, config.TCP[tcpListen])
+		go func(sock net.Listener) {
+			err := proxy.Serve(sock)
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
+			}
+		}(tcpSock)
+	}
+
+	// HTTP/2 without TLS (h2c), e.g. for gRPC clients
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Handler: plain, Protocols: protocols}
+
 	go func() {
 		log.Print("Flywheel starting")
-		err = http.Serve(sock, nil)
-		if err != nil {
+		err := server.Serve(sock)
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
@@ -92,7 +158,16 @@ func main() {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
 	<-ch
-	sock.Close()
 	log.Print("Stopping flywheel...")
-	time.Sleep(3 * time.Second)
+	for _, tcpSock := range tcpSocks {
+		tcpSock.Close()
+	}
+
+	// Give requests in flight a few seconds to finish
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	if tlsServer != nil {
+		tlsServer.Shutdown(ctx)
+	}
 }
@@ -5,26 +5,203 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
+	"path"
 	"time"
 )
 
 // Config flywheel config file
 type Config struct {
-	Vhosts      map[string]string `json:"vhosts"`
-	Region      string            `json:"aws_region"`
-	Endpoint    string            `json:"endpoint"`
-	Instances   []string          `json:"instances"`
-	HcInterval  Duration          `json:"healthcheck-interval"`
-	IdleTimeout Duration          `json:"idle-timeout"`
-	AutoScaling AutoScalingConfig `json:"autoscaling"`
+	Vhosts      map[string]string      `json:"vhosts"`
+	Region      string                 `json:"aws_region"`
+	Endpoint    string                 `json:"endpoint"`
+	Backends    Backends               `json:"backends"`
+	Routes      []Route                `json:"routes"`
+	Rewrite     RewriteConfig          `json:"rewrite"`
+	TrustProxy  bool                   `json:"trust-proxy"`
+	Timeout     Duration               `json:"upstream-timeout"`
+	Timeouts    map[string]Duration    `json:"upstream-timeouts"`
+	TLS         TLSConfig              `json:"tls"`
+	Upstreams   map[string]UpstreamTLS `json:"upstream-tls"`
+	TCP         map[string]string      `json:"tcp"`
+	TCPTimeout  Duration               `json:"tcp-start-timeout"`
+	Hold        HoldConfig             `json:"hold"`
+	Instances   []string               `json:"instances"`
+	Hibernate   []string               `json:"hibernate"`
+	Fallbacks   map[string][]string    `json:"fallback-instance-types"`
+	ElasticIPs  map[string]string      `json:"elastic-ips"`
+	Route53     []Route53Record        `json:"route53"`
+	Targets     map[string][]string    `json:"target-groups"`
+	IdleAction  string                 `json:"idle-action"`
+	Downsize    map[string]string      `json:"downsize"`
+	Release     Duration               `json:"release-volumes-after"`
+	HcInterval  Duration               `json:"healthcheck-interval"`
+	IdleTimeout Duration               `json:"idle-timeout"`
+	IdleStages  []IdleStage            `json:"idle-stages"`
+	LoadScaling map[string]LoadScaling `json:"load-scaling"`
+	LoadPeriod  Duration               `json:"load-scaling-interval"`
+	AutoScaling AutoScalingConfig      `json:"autoscaling"`
+	Redshift    []string               `json:"redshift"`
+	ElastiCache ElastiCacheConfig      `json:"elasticache"`
+	Spot        SpotConfig             `json:"spot"`
+	Ephemeral   map[string]Ephemeral   `json:"ephemeral"`
 }
 
 // AutoScalingConfig list of terminate/stop AWS ASG
 type AutoScalingConfig struct {
-	Terminate map[string]int64 `json:"terminate"`
-	Stop      []string         `json:"stop"`
+	Terminate        map[string]int64    `json:"terminate"`
+	Stop             []string            `json:"stop"`
+	SuspendProcesses map[string][]string `json:"suspend-processes"`
+	Standby          []string            `json:"standby"`
+	WarmPool         []string            `json:"warm-pool"`
+}
+
+// DefaultSuspendProcesses - processes suspended in stopped ASGs, unless
+// configured otherwise for the group
+var DefaultSuspendProcesses = []string{"ReplaceUnhealthy"}
+
+// scalingProcesses - processes that can be suspended in an ASG
+var scalingProcesses = map[string]bool{
+	"Launch":            true,
+	"Terminate":         true,
+	"AddToLoadBalancer": true,
+	"AlarmNotification": true,
+	"AZRebalance":       true,
+	"HealthCheck":       true,
+	"InstanceRefresh":   true,
+	"ReplaceUnhealthy":  true,
+	"ScheduledActions":  true,
+}
+
+// Processes retrieve the processes to suspend when stopping an ASG
+func (c *AutoScalingConfig) Processes(groupName string) []string {
+	if processes, ok := c.SuspendProcesses[groupName]; ok {
+		return processes
+	}
+	return DefaultSuspendProcesses
+}
+
+// ElastiCacheConfig list of ElastiCache replication groups, and the
+// environment variables holding their AUTH tokens
+type ElastiCacheConfig struct {
+	Snapshot   []string          `json:"snapshot"`
+	AuthTokens map[string]string `json:"auth-tokens"`
+}
+
+// SpotConfig settings for spot instances
+type SpotConfig struct {
+	OnDemandFallback []string `json:"on-demand-fallback"`
+}
+
+// FallsBack check if an ASG should switch to on-demand instances when spot
+// capacity is unavailable
+func (c *SpotConfig) FallsBack(groupName string) bool {
+	for _, name := range c.OnDemandFallback {
+		if name == groupName {
+			return true
+		}
+	}
+	return false
+}
+
+// Ephemeral - instances launched on start and terminated on stop. They
+// come from a launch template, or an AMI and instance type. SnapshotVolumes
+// lists the device names of data volumes kept as snapshots between launches.
+type Ephemeral struct {
+	LaunchTemplate        string   `json:"launch-template"`
+	LaunchTemplateVersion string   `json:"launch-template-version"`
+	ImageID               string   `json:"ami"`
+	InstanceType          string   `json:"instance-type"`
+	SubnetID              string   `json:"subnet-id"`
+	SecurityGroupIds      []string `json:"security-group-ids"`
+	Count                 int      `json:"count"`
+	SnapshotVolumes       []string `json:"snapshot-volumes"`
+}
+
+// Backends - discover the endpoint from the private IPs of the instances and
+// autoscaling group members, optionally only the ones with a tag ("key" or
+// "key=value"), instead of a static hostname
+type Backends struct {
+	Port        int      `json:"port"`
+	Tag         string   `json:"tag"`
+	AutoScaling []string `json:"autoscaling"`
+	Balance     string   `json:"balance"`
+}
+
+// TLSConfig - certificates for the HTTPS listener, by vhost hostname or
+// "default". Redirect makes the plain HTTP listener redirect to HTTPS.
+type TLSConfig struct {
+	Certificates map[string]CertificateFiles `json:"certificates"`
+	Redirect     bool                        `json:"redirect"`
+	Reload       Duration                    `json:"reload-interval"`
+}
+
+// CertificateFiles - PEM files of a certificate (with its chain) and its key
+type CertificateFiles struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// HoldConfig - requests which start the environment and wait for it, instead
+// of getting the stopped or starting page: by hostname, path prefix, or a
+// request header being set. Their bodies are buffered up to MaxBody bytes.
+type HoldConfig struct {
+	Vhosts  []string `json:"vhosts"`
+	Paths   []string `json:"paths"`
+	Header  string   `json:"header"`
+	Timeout Duration `json:"timeout"`
+	MaxBody int64    `json:"max-body"`
+}
+
+// RewriteConfig - rewriting of backend hostnames in responses to the public
+// hostname: in the Location, Content-Location and Set-Cookie headers, and the
+// absolute links of HTML pages. The backend proxied to is always rewritten,
+// Hostnames adds others, e.g. internal hostnames of the backends.
+type RewriteConfig struct {
+	Hostnames []string `json:"hostnames"`
+	Headers   bool     `json:"headers"`
+	HTML      bool     `json:"html"`
+}
+
+// UpstreamTLS - TLS settings for a HTTPS backend: a CA bundle to verify it
+// with, a client certificate and key, the SNI hostname to send, or skipping
+// verification for self signed certificates
+type UpstreamTLS struct {
+	CA         string `json:"ca"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ServerName string `json:"server-name"`
+	Insecure   bool   `json:"insecure-skip-verify"`
+}
+
+// Route53Record - an A record to point to the IPs of instances on start.
+// Private uses the private IPs of the instances instead of the public ones.
+type Route53Record struct {
+	ZoneID    string   `json:"zone-id"`
+	Name      string   `json:"name"`
+	Instances []string `json:"instances"`
+	TTL       int64    `json:"ttl"`
+	Private   bool     `json:"private"`
+}
+
+// IdleStage - autoscaling groups to shrink after being idle for a while,
+// before the idle timeout powers everything down
+type IdleStage struct {
+	Name        string           `json:"name"`
+	After       Duration         `json:"after"`
+	AutoScaling map[string]int64 `json:"autoscaling"`
+}
+
+// LoadScaling - bounds and targets for scaling an ASG on the proxied load while
+// started. RequestRate is requests per second per instance, Connections is
+// concurrent connections per instance.
+type LoadScaling struct {
+	MinSize     int64   `json:"min"`
+	MaxSize     int64   `json:"max"`
+	RequestRate float64 `json:"requests-per-second"`
+	Connections int64   `json:"connections"`
 }
 
 // Duration helper type to parse duration from json
@@ -83,6 +260,26 @@ func (c *Config) AwsInstances() []*string {
 	return awsIds
 }
 
+// Hibernates check if an instance or ASG should be hibernated instead of stopped
+func (c *Config) Hibernates(name string) bool {
+	for _, hibernate := range c.Hibernate {
+		if hibernate == name {
+			return true
+		}
+	}
+	return false
+}
+
+// manages check if an instance is in the list of instances
+func (c *Config) manages(instanceID string) bool {
+	for _, id := range c.Instances {
+		if id == instanceID {
+			return true
+		}
+	}
+	return false
+}
+
 // EndpointURL get endpoint URL as an URL type
 func (c *Config) EndpointURL() (*url.URL, error) {
 	return url.Parse(c.Endpoint)
@@ -90,14 +287,167 @@ func (c *Config) EndpointURL() (*url.URL, error) {
 
 // Validate config content
 func (c *Config) Validate() error {
-	if len(c.Instances) == 0 && len(c.AutoScaling.Stop) == 0 && len(c.AutoScaling.Terminate) == 0 {
-		return fmt.Errorf("No instances or asg configured")
+	if len(c.Instances) == 0 && len(c.AutoScaling.Stop) == 0 && len(c.AutoScaling.Terminate) == 0 &&
+		len(c.AutoScaling.Standby) == 0 && len(c.AutoScaling.WarmPool) == 0 && len(c.Redshift) == 0 && len(c.ElastiCache.Snapshot) == 0 &&
+		len(c.Ephemeral) == 0 {
+		return fmt.Errorf("No instances, asg, redshift, elasticache or ephemeral instances configured")
 	}
 
-	if len(c.Endpoint) == 0 {
+	if len(c.Endpoint) == 0 && c.Backends.Port == 0 {
 		return fmt.Errorf("No endpoint configured")
 	}
 
+	for hostname, files := range c.TLS.Certificates {
+		if _, ok := c.Vhosts[hostname]; !ok && hostname != DefaultCertificate {
+			return fmt.Errorf("Certificate configured for %s, which is not in vhosts", hostname)
+		}
+		if files.Cert == "" || files.Key == "" {
+			return fmt.Errorf("Certificate for %s needs a cert and a key", hostname)
+		}
+	}
+	if c.TLS.Redirect && len(c.TLS.Certificates) == 0 {
+		return fmt.Errorf("HTTPS redirect needs certificates")
+	}
+	if c.TLS.Reload <= 0 {
+		c.TLS.Reload = Duration(time.Minute)
+	}
+
+	if len(c.Endpoint) > 0 {
+		if _, err := ParseTarget(c.Endpoint); err != nil {
+			return fmt.Errorf("Invalid endpoint: %v", err)
+		}
+	}
+	for hostname, target := range c.Vhosts {
+		if _, err := ParseTarget(target); err != nil {
+			return fmt.Errorf("Invalid target for vhost %s: %v", hostname, err)
+		}
+	}
+	for _, pattern := range c.Rewrite.Hostnames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid rewrite hostname %s: %v", pattern, err)
+		}
+	}
+	for i := range c.Routes {
+		if err := c.Routes[i].compile(); err != nil {
+			return fmt.Errorf("Invalid route %d: %v", i+1, err)
+		}
+	}
+	for backend, settings := range c.Upstreams {
+		if (settings.Cert == "") != (settings.Key == "") {
+			return fmt.Errorf("Client certificate for %s needs a cert and a key", backend)
+		}
+	}
+
+	for listen, backend := range c.TCP {
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return fmt.Errorf("Invalid tcp listen address %s: %v", listen, err)
+		}
+		if _, _, err := net.SplitHostPort(backend); err != nil {
+			return fmt.Errorf("Invalid tcp backend %s for %s: %v", backend, listen, err)
+		}
+	}
+	if c.TCPTimeout <= 0 {
+		c.TCPTimeout = Duration(5 * time.Minute)
+	}
+
+	if c.Hold.Timeout <= 0 {
+		c.Hold.Timeout = Duration(5 * time.Minute)
+	}
+	if c.Hold.MaxBody <= 0 {
+		c.Hold.MaxBody = 10 << 20
+	}
+
+	for hostname := range c.Timeouts {
+		if _, ok := c.Vhosts[hostname]; !ok {
+			return fmt.Errorf("Upstream timeout configured for %s, which is not in vhosts", hostname)
+		}
+	}
+
+	if c.Backends.Port < 0 || c.Backends.Port > 65535 {
+		return fmt.Errorf("Invalid backends port %d", c.Backends.Port)
+	}
+	switch c.Backends.Balance {
+	case "":
+		c.Backends.Balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConn:
+	default:
+		return fmt.Errorf("Unknown backends balance %s", c.Backends.Balance)
+	}
+
+	for instanceID := range c.Fallbacks {
+		if !c.manages(instanceID) {
+			return fmt.Errorf("Fallback instance types configured for %s, which is not in instances", instanceID)
+		}
+	}
+
+	for instanceID := range c.ElasticIPs {
+		if !c.manages(instanceID) {
+			return fmt.Errorf("Elastic IP configured for %s, which is not in instances", instanceID)
+		}
+	}
+
+	for targetGroupArn, instanceIds := range c.Targets {
+		for _, instanceID := range instanceIds {
+			if !c.manages(instanceID) {
+				return fmt.Errorf("Target group %s configured for %s, which is not in instances", targetGroupArn, instanceID)
+			}
+		}
+	}
+
+	for i := range c.Route53 {
+		record := &c.Route53[i]
+		if record.ZoneID == "" || record.Name == "" || len(record.Instances) == 0 {
+			return fmt.Errorf("Route53 records need a zone-id, name and instances")
+		}
+		for _, instanceID := range record.Instances {
+			if !c.manages(instanceID) {
+				return fmt.Errorf("Route53 record %s configured for %s, which is not in instances", record.Name, instanceID)
+			}
+		}
+		if record.TTL <= 0 {
+			record.TTL = 60
+		}
+	}
+
+	switch c.IdleAction {
+	case "":
+		c.IdleAction = IdleStop
+	case IdleStop:
+	case IdleDownsize:
+		if len(c.Downsize) == 0 {
+			return fmt.Errorf("Idle action %s needs instances to downsize", c.IdleAction)
+		}
+	default:
+		return fmt.Errorf("Unknown idle action %s", c.IdleAction)
+	}
+
+	for instanceID := range c.Downsize {
+		if !c.manages(instanceID) {
+			return fmt.Errorf("Downsize configured for %s, which is not in instances", instanceID)
+		}
+	}
+
+	for groupName, processes := range c.AutoScaling.SuspendProcesses {
+		for _, process := range processes {
+			if !scalingProcesses[process] {
+				return fmt.Errorf("Unknown process %s to suspend in %s", process, groupName)
+			}
+		}
+	}
+
+	for name, ephemeral := range c.Ephemeral {
+		if ephemeral.LaunchTemplate == "" && (ephemeral.ImageID == "" || ephemeral.InstanceType == "") {
+			return fmt.Errorf("Ephemeral instances %s need a launch-template, or an ami and instance-type", name)
+		}
+		if ephemeral.LaunchTemplate != "" && ephemeral.LaunchTemplateVersion == "" {
+			ephemeral.LaunchTemplateVersion = "$Default"
+		}
+		if ephemeral.Count <= 0 {
+			ephemeral.Count = 1
+		}
+		c.Ephemeral[name] = ephemeral
+	}
+
 	if c.HcInterval <= 0 {
 		c.HcInterval = Duration(30 * time.Second)
 	}
@@ -106,9 +456,52 @@ func (c *Config) Validate() error {
 		c.IdleTimeout = Duration(3 * time.Hour)
 	}
 
+	var after Duration
+	for i := range c.IdleStages {
+		stage := &c.IdleStages[i]
+		if stage.Name == "" {
+			stage.Name = time.Duration(stage.After).String()
+		}
+		if stage.After <= after || stage.After >= c.IdleTimeout {
+			return fmt.Errorf("Idle stage %s must come after the previous stage and before the idle timeout", stage.Name)
+		}
+		after = stage.After
+
+		for groupName := range stage.AutoScaling {
+			if _, ok := c.AutoScaling.Terminate[groupName]; !ok && !contains(c.AutoScaling.WarmPool, groupName) {
+				return fmt.Errorf("Idle stage %s can only shrink terminate or warm-pool autoscaling groups, not %s", stage.Name, groupName)
+			}
+		}
+	}
+
+	if c.LoadPeriod <= 0 {
+		c.LoadPeriod = Duration(time.Minute)
+	}
+
+	for groupName, scaling := range c.LoadScaling {
+		if _, ok := c.AutoScaling.Terminate[groupName]; !ok && !contains(c.AutoScaling.WarmPool, groupName) {
+			return fmt.Errorf("Load scaling only works with terminate or warm-pool autoscaling groups, not %s", groupName)
+		}
+		if scaling.MinSize < 0 || scaling.MaxSize < scaling.MinSize {
+			return fmt.Errorf("Invalid load scaling min/max for %s", groupName)
+		}
+		if scaling.RequestRate <= 0 && scaling.Connections <= 0 {
+			return fmt.Errorf("Load scaling for %s needs requests-per-second or connections", groupName)
+		}
+	}
+
 	if c.Region == "" {
 		c.Region = "ap-southeast-2"
 	}
 
 	return nil
 }
+
+func contains(list []string, item string) bool {
+	for _, value := range list {
+		if value == item {
+			return true
+		}
+	}
+	return false
+}
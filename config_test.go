@@ -123,3 +123,468 @@ func TestMissingEndpointConfig(t *testing.T) {
 	}
 
 }
+
+// Only data stores, no instances or autoscaling groups
+var configDataStoresJSON = `
+{
+  "endpoint": "dev.example.com",
+  "redshift": [
+    "my-analytics-cluster"
+  ],
+  "elasticache": {
+    "snapshot": [
+      "my-redis-group"
+    ]
+  }
+}
+`
+
+func TestDataStoresConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configDataStoresJSON)); err != nil {
+		t.Errorf("Expexted no error, but got %s", err)
+	}
+
+	if len(c.Redshift) != 1 || c.Redshift[0] != "my-analytics-cluster" {
+		t.Errorf("Expected redshift cluster my-analytics-cluster, but got %v", c.Redshift)
+	}
+
+	if len(c.ElastiCache.Snapshot) != 1 || c.ElastiCache.Snapshot[0] != "my-redis-group" {
+		t.Errorf("Expected elasticache group my-redis-group, but got %v", c.ElastiCache.Snapshot)
+	}
+}
+
+var configSuspendProcessesJSON = `
+{
+  "endpoint": "dev.example.com",
+  "autoscaling": {
+    "stop": [
+      "my-unsafe-scaling-group",
+      "my-other-scaling-group"
+    ],
+    "suspend-processes": {
+      "my-unsafe-scaling-group": ["AZRebalance", "HealthCheck", "ReplaceUnhealthy"]
+    }
+  }
+}
+`
+
+func TestSuspendProcessesConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configSuspendProcessesJSON)); err != nil {
+		t.Errorf("Expexted no error, but got %s", err)
+	}
+
+	if p := c.AutoScaling.Processes("my-unsafe-scaling-group"); len(p) != 3 || p[0] != "AZRebalance" {
+		t.Errorf("Expected configured processes, but got %v", p)
+	}
+
+	if p := c.AutoScaling.Processes("my-other-scaling-group"); len(p) != 1 || p[0] != "ReplaceUnhealthy" {
+		t.Errorf("Expected default processes, but got %v", p)
+	}
+}
+
+var configBadSuspendProcessesJSON = `
+{
+  "endpoint": "dev.example.com",
+  "autoscaling": {
+    "stop": [
+      "my-unsafe-scaling-group"
+    ],
+    "suspend-processes": {
+      "my-unsafe-scaling-group": ["ReplaceUnhealthy", "Everything"]
+    }
+  }
+}
+`
+
+func TestBadSuspendProcessesConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configBadSuspendProcessesJSON)); err == nil {
+		t.Errorf("Expexted an error for unknown process, but got none")
+	}
+}
+
+func TestHibernateConfig(t *testing.T) {
+	c := &Config{
+		Endpoint:  "dev.example.com",
+		Instances: []string{"i-deadbeef", "i-cafebabe"},
+		Hibernate: []string{"i-cafebabe", "my-unsafe-scaling-group"},
+	}
+
+	if c.Hibernates("i-deadbeef") {
+		t.Errorf("Expected i-deadbeef to be stopped, not hibernated")
+	}
+
+	if !c.Hibernates("i-cafebabe") || !c.Hibernates("my-unsafe-scaling-group") {
+		t.Errorf("Expected i-cafebabe and my-unsafe-scaling-group to be hibernated")
+	}
+}
+
+var configBadFallbacksJSON = `
+{
+  "endpoint": "dev.example.com",
+  "instances": [
+    "i-deadbeef"
+  ],
+  "fallback-instance-types": {
+    "i-cafebabe": ["m5.large", "m5a.large"]
+  }
+}
+`
+
+func TestBadFallbacksConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configBadFallbacksJSON)); err == nil {
+		t.Errorf("Expexted an error for fallback of unmanaged instance, but got none")
+	}
+}
+
+var configDownsizeJSON = `
+{
+  "endpoint": "dev.example.com",
+  "instances": [
+    "i-deadbeef",
+    "i-cafebabe"
+  ],
+  "idle-action": "downsize",
+  "downsize": {
+    "i-deadbeef": "t3.small"
+  }
+}
+`
+
+func TestDownsizeConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configDownsizeJSON)); err != nil {
+		t.Errorf("Expexted no error, but got %s", err)
+	}
+
+	if c.IdleAction != IdleDownsize {
+		t.Errorf("Expected idle action downsize, but got %s", c.IdleAction)
+	}
+}
+
+func TestDefaultIdleActionConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configDefaultJSONV0_1)); err != nil {
+		t.Errorf("Expexted no error, but got %s", err)
+	}
+
+	if c.IdleAction != IdleStop {
+		t.Errorf("Expected idle action stop, but got %s", c.IdleAction)
+	}
+}
+
+var configBadDownsizeJSON = `
+{
+  "endpoint": "dev.example.com",
+  "instances": [
+    "i-deadbeef"
+  ],
+  "idle-action": "downsize"
+}
+`
+
+func TestBadDownsizeConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configBadDownsizeJSON)); err == nil {
+		t.Errorf("Expexted an error for downsize without instance types, but got none")
+	}
+}
+
+var configIdleStagesJSON = `
+{
+  "endpoint": "dev.example.com",
+  "idle-timeout": "3h",
+  "idle-stages": [
+    {
+      "after": "30m",
+      "autoscaling": {
+        "my-safe-scaling-group": 1
+      }
+    }
+  ],
+  "autoscaling": {
+    "terminate": {
+      "my-safe-scaling-group": 0
+    }
+  }
+}
+`
+
+func TestIdleStagesConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configIdleStagesJSON)); err != nil {
+		t.Errorf("Expexted no error, but got %s", err)
+	}
+
+	if len(c.IdleStages) != 1 || c.IdleStages[0].After != Duration(30*time.Minute) {
+		t.Errorf("Expected one idle stage after 30m, but got %v", c.IdleStages)
+	}
+
+	if c.IdleStages[0].Name != "30m0s" {
+		t.Errorf("Expected default idle stage name 30m0s, but got %s", c.IdleStages[0].Name)
+	}
+}
+
+var configBadIdleStagesJSON = `
+{
+  "endpoint": "dev.example.com",
+  "idle-timeout": "1h",
+  "idle-stages": [
+    {
+      "name": "too-late",
+      "after": "2h",
+      "autoscaling": {
+        "my-safe-scaling-group": 1
+      }
+    }
+  ],
+  "autoscaling": {
+    "terminate": {
+      "my-safe-scaling-group": 0
+    }
+  }
+}
+`
+
+func TestBadIdleStagesConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configBadIdleStagesJSON)); err == nil {
+		t.Errorf("Expexted an error for idle stage after the idle timeout, but got none")
+	}
+}
+
+var configLoadScalingJSON = `
+{
+  "endpoint": "dev.example.com",
+  "load-scaling": {
+    "my-safe-scaling-group": {
+      "min": 1,
+      "max": 4,
+      "requests-per-second": 20
+    }
+  },
+  "autoscaling": {
+    "terminate": {
+      "my-safe-scaling-group": 0
+    }
+  }
+}
+`
+
+func TestLoadScalingConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configLoadScalingJSON)); err != nil {
+		t.Errorf("Expexted no error, but got %s", err)
+	}
+
+	if c.LoadPeriod != Duration(time.Minute) {
+		t.Errorf("Expected load scaling interval 1m, but got %v", c.LoadPeriod)
+	}
+
+	if c.LoadScaling["my-safe-scaling-group"].MaxSize != 4 {
+		t.Errorf("Expected load scaling max 4, but got %v", c.LoadScaling)
+	}
+}
+
+var configEphemeralJSON = `
+{
+  "endpoint": "dev.example.com",
+  "ephemeral": {
+    "worker": {
+      "launch-template": "my-worker-template",
+      "snapshot-volumes": ["/dev/sdf"]
+    }
+  }
+}
+`
+
+func TestEphemeralConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configEphemeralJSON)); err != nil {
+		t.Errorf("Expexted no error, but got %s", err)
+	}
+
+	if c.Ephemeral["worker"].Count != 1 {
+		t.Errorf("Expected 1 ephemeral instance, but got %d", c.Ephemeral["worker"].Count)
+	}
+
+	if c.Ephemeral["worker"].LaunchTemplateVersion != "$Default" {
+		t.Errorf("Expected launch template version $Default, but got %s", c.Ephemeral["worker"].LaunchTemplateVersion)
+	}
+}
+
+var configBadEphemeralJSON = `
+{
+  "endpoint": "dev.example.com",
+  "ephemeral": {
+    "worker": {
+      "ami": "ami-12345678"
+    }
+  }
+}
+`
+
+func TestBadEphemeralConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configBadEphemeralJSON)); err == nil {
+		t.Errorf("Expexted an error for an ami without instance type, but got none")
+	}
+}
+
+var configReleaseVolumesJSON = `
+{
+  "endpoint": "dev.example.com",
+  "instances": ["i-12345678"],
+  "release-volumes-after": "336h"
+}
+`
+
+func TestReleaseVolumesConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configReleaseVolumesJSON)); err != nil {
+		t.Errorf("Expexted no error, but got %s", err)
+	}
+
+	if c.Release != Duration(14*24*time.Hour) {
+		t.Errorf("Expected volumes released after 14 days, but got %v", time.Duration(c.Release))
+	}
+}
+
+var configRoute53JSON = `
+{
+  "endpoint": "dev.example.com",
+  "instances": ["i-12345678"],
+  "elastic-ips": {
+    "i-12345678": "eipalloc-12345678"
+  },
+  "route53": [
+    {
+      "zone-id": "Z123456789",
+      "name": "dev.example.com",
+      "instances": ["i-12345678"]
+    }
+  ]
+}
+`
+
+func TestRoute53Config(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configRoute53JSON)); err != nil {
+		t.Errorf("Expexted no error, but got %s", err)
+	}
+
+	if c.Route53[0].TTL != 60 {
+		t.Errorf("Expected default TTL of 60, but got %d", c.Route53[0].TTL)
+	}
+}
+
+var configBadRoute53JSON = `
+{
+  "endpoint": "dev.example.com",
+  "instances": ["i-12345678"],
+  "route53": [
+    {
+      "zone-id": "Z123456789",
+      "name": "dev.example.com",
+      "instances": ["i-87654321"]
+    }
+  ]
+}
+`
+
+func TestBadRoute53Config(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configBadRoute53JSON)); err == nil {
+		t.Errorf("Expexted an error for a record of an unknown instance, but got none")
+	}
+}
+
+var configBadTargetGroupsJSON = `
+{
+  "endpoint": "dev.example.com",
+  "instances": ["i-12345678"],
+  "target-groups": {
+    "arn:aws:elasticloadbalancing:ap-southeast-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067": ["i-87654321"]
+  }
+}
+`
+
+func TestBadTargetGroupsConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configBadTargetGroupsJSON)); err == nil {
+		t.Errorf("Expexted an error for a target of an unknown instance, but got none")
+	}
+}
+
+var configBadVhostTargetJSON = `
+{
+  "endpoint": "dev.example.com",
+  "instances": ["i-12345678"],
+  "vhosts": {
+    "www.example.org": "ftp://backend.example.org"
+  }
+}
+`
+
+func TestBadVhostTargetConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configBadVhostTargetJSON)); err == nil {
+		t.Errorf("Expexted an error for an unsupported vhost scheme, but got none")
+	}
+}
+
+var configBadTCPBackendJSON = `
+{
+  "endpoint": "dev.example.com",
+  "instances": ["i-12345678"],
+  "tcp": {
+    "0.0.0.0:5432": "db.example.com"
+  }
+}
+`
+
+func TestBadTCPBackendConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configBadTCPBackendJSON)); err == nil {
+		t.Errorf("Expexted an error for a tcp backend without a port, but got none")
+	}
+}
+
+var configBadRouteJSON = `
+{
+  "endpoint": "dev.example.com",
+  "instances": ["i-12345678"],
+  "routes": [
+    {"host-regex": "(api", "backend": "api.example.com"}
+  ]
+}
+`
+
+func TestBadRouteConfig(t *testing.T) {
+	c := &Config{}
+
+	if err := c.Parse(bytes.NewBufferString(configBadRouteJSON)); err == nil {
+		t.Errorf("Expexted an error for an invalid host regex, but got none")
+	}
+}
@@ -0,0 +1,185 @@
+package flywheel
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// IdleStop and IdleDownsize are the actions taken after the idle timeout
+const (
+	IdleStop     = "stop"
+	IdleDownsize = "downsize"
+)
+
+// Downsize - switch the instances configured for it to their small instance
+// type, keeping the environment reachable. Instances have to be stopped to
+// change type, which is done by the healthcheck once they are.
+func (fw *Flywheel) Downsize() error {
+	log.Print("Downsizing instances")
+
+	originals := make(map[string]string)
+	var instanceIds []*string
+	for instanceID := range fw.config.Downsize {
+		resp, err := fw.ec2.DescribeInstanceAttribute(
+			&ec2.DescribeInstanceAttributeInput{
+				InstanceId: aws.String(instanceID),
+				Attribute:  aws.String(ec2.InstanceAttributeNameInstanceType),
+			},
+		)
+		if err != nil {
+			log.Printf("Error downsizing: %v", err)
+			return err
+		}
+		originals[instanceID] = aws.StringValue(resp.InstanceType.Value)
+		instanceIds = append(instanceIds, aws.String(instanceID))
+	}
+
+	if err := fw.restartResized(instanceIds, fw.config.Downsize); err != nil {
+		return err
+	}
+	fw.stateLock.Lock()
+	fw.state.Downsized = originals
+	fw.stateLock.Unlock()
+	return nil
+}
+
+// Upsize - switch downsized instances back to their original instance type
+func (fw *Flywheel) Upsize() error {
+	log.Print("Activity while downsized, restoring instance types")
+
+	fw.stateLock.Lock()
+	originals := fw.state.Downsized
+	fw.stateLock.Unlock()
+
+	var instanceIds []*string
+	for instanceID := range originals {
+		instanceIds = append(instanceIds, aws.String(instanceID))
+	}
+
+	if err := fw.restartResized(instanceIds, originals); err != nil {
+		return err
+	}
+	fw.stateLock.Lock()
+	fw.state.Downsized = nil
+	fw.stateLock.Unlock()
+
+	fw.lastStarted = time.Now()
+	return nil
+}
+
+// restartResized - stop instances so the healthcheck can resize and start
+// them. The resize is only recorded once they are stopping, so a failure
+// leaves the instances as they are and the resize is tried again.
+func (fw *Flywheel) restartResized(instanceIds []*string, types map[string]string) error {
+	_, err := fw.ec2.StopInstances(
+		&ec2.StopInstancesInput{
+			InstanceIds: instanceIds,
+		},
+	)
+	if err != nil {
+		log.Printf("Error resizing: %v", err)
+		return err
+	}
+	for instanceID, instanceType := range types {
+		fw.resizeTo(instanceID, instanceType)
+	}
+
+	fw.ready = false
+	fw.status = STARTING
+	fw.stopAt = time.Now().Add(fw.idleTimeout)
+	fw.lastActive = time.Now()
+	return nil
+}
+
+// restoreDownsized - on a full start, switch downsized instances back to
+// their original instance type before they are started. The instances have
+// to be stopped.
+func (fw *Flywheel) restoreDownsized() error {
+	fw.stateLock.Lock()
+	originals := fw.state.Downsized
+	fw.state.Downsized = nil
+	fw.state.Resizing = nil
+	fw.stateLock.Unlock()
+
+	for instanceID, instanceType := range originals {
+		log.Printf("Restoring instance %s to type %s", instanceID, instanceType)
+		_, err := fw.ec2.ModifyInstanceAttribute(
+			&ec2.ModifyInstanceAttributeInput{
+				InstanceId:   aws.String(instanceID),
+				InstanceType: &ec2.AttributeValue{Value: aws.String(instanceType)},
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downsized - check if the instances are currently downsized
+func (fw *Flywheel) downsized() bool {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	return len(fw.state.Downsized) > 0
+}
+
+func (fw *Flywheel) resizeTo(instanceID, instanceType string) {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	if fw.state.Resizing == nil {
+		fw.state.Resizing = make(map[string]string)
+	}
+	fw.state.Resizing[instanceID] = instanceType
+}
+
+// checkResizing - move a resizing instance along once it has stopped. Returns
+// the state to report for the instance: all of the resize counts as pending.
+func (fw *Flywheel) checkResizing(instance *ec2.Instance) (string, error) {
+	state := *instance.State.Name
+
+	fw.stateLock.Lock()
+	instanceType, ok := fw.state.Resizing[*instance.InstanceId]
+	fw.stateLock.Unlock()
+	if !ok {
+		return state, nil
+	}
+
+	switch state {
+	case "stopped":
+		log.Printf("Resizing instance %s to type %s", *instance.InstanceId, instanceType)
+		_, err := fw.ec2.ModifyInstanceAttribute(
+			&ec2.ModifyInstanceAttributeInput{
+				InstanceId:   instance.InstanceId,
+				InstanceType: &ec2.AttributeValue{Value: aws.String(instanceType)},
+			},
+		)
+		if err != nil {
+			return state, err
+		}
+
+		_, err = fw.ec2.StartInstances(
+			&ec2.StartInstancesInput{
+				InstanceIds: []*string{instance.InstanceId},
+			},
+		)
+		if err != nil {
+			return state, err
+		}
+
+		fw.stateLock.Lock()
+		delete(fw.state.Resizing, *instance.InstanceId)
+		fw.stateLock.Unlock()
+		return "pending", nil
+
+	case "stopping", "running":
+		return "pending", nil
+
+	default:
+		return state, nil
+	}
+}
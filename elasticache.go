@@ -0,0 +1,302 @@
+package flywheel
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+)
+
+// ElastiCacheGroup - settings of a deleted ElastiCache replication group that
+// are not kept in its snapshot, but are needed to recreate it.
+type ElastiCacheGroup struct {
+	Snapshot             string   `json:"snapshot"`
+	Description          string   `json:"description"`
+	CacheNodeType        string   `json:"cache-node-type"`
+	ParameterGroupName   string   `json:"parameter-group-name,omitempty"`
+	SubnetGroupName      string   `json:"subnet-group-name,omitempty"`
+	SecurityGroupIds     []string `json:"security-group-ids,omitempty"`
+	ClusterEnabled       bool     `json:"cluster-enabled"`
+	NumNodeGroups        int64    `json:"num-node-groups"`
+	ReplicasPerNodeGroup int64    `json:"replicas-per-node-group"`
+	AutomaticFailover    bool     `json:"automatic-failover"`
+	MultiAZ              bool     `json:"multi-az"`
+	AtRestEncryption     bool     `json:"at-rest-encryption,omitempty"`
+	KmsKeyID             string   `json:"kms-key-id,omitempty"`
+	TransitEncryption    bool     `json:"transit-encryption,omitempty"`
+	TransitMode          string   `json:"transit-encryption-mode,omitempty"`
+	AuthToken            bool     `json:"auth-token,omitempty"`
+	UserGroupIds         []string `json:"user-group-ids,omitempty"`
+}
+
+// elastiCacheStates maps ElastiCache replication group statuses to the EC2
+// instance states used by the healthcheck.
+var elastiCacheStates = map[string]string{
+	"available":    "running",
+	"modifying":    "running",
+	"snapshotting": "running",
+	"creating":     "pending",
+	"deleting":     "stopping",
+}
+
+// elastiCacheSnapshotName - name of the final snapshot taken when a
+// replication group is deleted. Reused on every stop so the healthcheck can
+// find it without any saved state.
+func elastiCacheSnapshotName(groupID string) string {
+	return "flywheel-" + groupID
+}
+
+// Recreate ElastiCache replication groups from the snapshot taken when they
+// were stopped. Groups which already exist again count as restored.
+func (fw *Flywheel) restoreElastiCache() error {
+	for _, groupID := range fw.config.ElastiCache.Snapshot {
+		fw.stateLock.Lock()
+		saved, ok := fw.state.ElastiCache[groupID]
+		fw.stateLock.Unlock()
+		if !ok {
+			log.Printf("No snapshot recorded for elasticache group %s, skipping restore", groupID)
+			continue
+		}
+
+		log.Printf("Restoring elasticache group %s from snapshot %s", groupID, saved.Snapshot)
+		input := &elasticache.CreateReplicationGroupInput{
+			ReplicationGroupId:          aws.String(groupID),
+			ReplicationGroupDescription: aws.String(saved.Description),
+			SnapshotName:                aws.String(saved.Snapshot),
+			CacheNodeType:               aws.String(saved.CacheNodeType),
+			SecurityGroupIds:            aws.StringSlice(saved.SecurityGroupIds),
+			AutomaticFailoverEnabled:    aws.Bool(saved.AutomaticFailover),
+			MultiAZEnabled:              aws.Bool(saved.MultiAZ),
+		}
+		if saved.ParameterGroupName != "" {
+			input.CacheParameterGroupName = aws.String(saved.ParameterGroupName)
+		}
+		if saved.SubnetGroupName != "" {
+			input.CacheSubnetGroupName = aws.String(saved.SubnetGroupName)
+		}
+		if saved.AtRestEncryption {
+			input.AtRestEncryptionEnabled = aws.Bool(true)
+			if saved.KmsKeyID != "" {
+				input.KmsKeyId = aws.String(saved.KmsKeyID)
+			}
+		}
+		if saved.TransitEncryption {
+			input.TransitEncryptionEnabled = aws.Bool(true)
+			if saved.TransitMode != "" {
+				input.TransitEncryptionMode = aws.String(saved.TransitMode)
+			}
+		}
+		if saved.AuthToken {
+			token, err := fw.elastiCacheAuthToken(groupID)
+			if err != nil {
+				return err
+			}
+			input.AuthToken = aws.String(token)
+		}
+		if len(saved.UserGroupIds) > 0 {
+			input.UserGroupIds = aws.StringSlice(saved.UserGroupIds)
+		}
+		if saved.ClusterEnabled {
+			input.NumNodeGroups = aws.Int64(saved.NumNodeGroups)
+			input.ReplicasPerNodeGroup = aws.Int64(saved.ReplicasPerNodeGroup)
+		} else {
+			input.NumCacheClusters = aws.Int64(saved.ReplicasPerNodeGroup + 1)
+		}
+
+		_, err := fw.elasticache.CreateReplicationGroup(input)
+		if err != nil && !isAwsError(err, elasticache.ErrCodeReplicationGroupAlreadyExistsFault) {
+			return err
+		}
+
+		fw.stateLock.Lock()
+		delete(fw.state.ElastiCache, groupID)
+		fw.stateLock.Unlock()
+	}
+	return nil
+}
+
+// Snapshot ElastiCache replication groups and delete them. They cannot be
+// stopped, so this is the only way to stop paying for the nodes. Groups
+// already deleted are skipped, so a failed stop can be retried.
+func (fw *Flywheel) snapshotElastiCache() error {
+	for _, groupID := range fw.config.ElastiCache.Snapshot {
+		fw.stateLock.Lock()
+		_, deleted := fw.state.ElastiCache[groupID]
+		fw.stateLock.Unlock()
+		if deleted {
+			continue
+		}
+
+		log.Printf("Snapshotting and deleting elasticache group %s", groupID)
+
+		saved, err := fw.describeElastiCacheGroup(groupID)
+		if err != nil {
+			return err
+		}
+
+		// The final snapshot name has to be free, so drop the one left
+		// over from the previous stop.
+		_, err = fw.elasticache.DeleteSnapshot(
+			&elasticache.DeleteSnapshotInput{
+				SnapshotName: aws.String(saved.Snapshot),
+			},
+		)
+		if err != nil && !isAwsError(err, elasticache.ErrCodeSnapshotNotFoundFault) {
+			return err
+		}
+
+		_, err = fw.elasticache.DeleteReplicationGroup(
+			&elasticache.DeleteReplicationGroupInput{
+				ReplicationGroupId:      aws.String(groupID),
+				FinalSnapshotIdentifier: aws.String(saved.Snapshot),
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		fw.stateLock.Lock()
+		if fw.state.ElastiCache == nil {
+			fw.state.ElastiCache = make(map[string]ElastiCacheGroup)
+		}
+		fw.state.ElastiCache[groupID] = *saved
+		fw.stateLock.Unlock()
+		fw.persist()
+	}
+	return nil
+}
+
+// describeElastiCacheGroup - collect the settings needed to recreate a
+// replication group from its snapshot.
+func (fw *Flywheel) describeElastiCacheGroup(groupID string) (*ElastiCacheGroup, error) {
+	resp, err := fw.elasticache.DescribeReplicationGroups(
+		&elasticache.DescribeReplicationGroupsInput{
+			ReplicationGroupId: aws.String(groupID),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.ReplicationGroups) == 0 || len(resp.ReplicationGroups[0].MemberClusters) == 0 {
+		return nil, fmt.Errorf("ElastiCache group %s has no member clusters", groupID)
+	}
+	group := resp.ReplicationGroups[0]
+
+	saved := &ElastiCacheGroup{
+		Snapshot:          elastiCacheSnapshotName(groupID),
+		Description:       aws.StringValue(group.Description),
+		CacheNodeType:     aws.StringValue(group.CacheNodeType),
+		ClusterEnabled:    aws.BoolValue(group.ClusterEnabled),
+		NumNodeGroups:     int64(len(group.NodeGroups)),
+		AutomaticFailover: aws.StringValue(group.AutomaticFailover) == elasticache.AutomaticFailoverStatusEnabled,
+		MultiAZ:           aws.StringValue(group.MultiAZ) == elasticache.MultiAZStatusEnabled,
+		AtRestEncryption:  aws.BoolValue(group.AtRestEncryptionEnabled),
+		KmsKeyID:          aws.StringValue(group.KmsKeyId),
+		TransitEncryption: aws.BoolValue(group.TransitEncryptionEnabled),
+		TransitMode:       aws.StringValue(group.TransitEncryptionMode),
+		AuthToken:         aws.BoolValue(group.AuthTokenEnabled),
+		UserGroupIds:      aws.StringValueSlice(group.UserGroupIds),
+	}
+
+	// The AUTH token can't be read back, so don't delete a group which
+	// couldn't be recreated with it
+	if saved.AuthToken {
+		if _, err := fw.elastiCacheAuthToken(groupID); err != nil {
+			return nil, err
+		}
+	}
+	if len(group.NodeGroups) > 0 && len(group.NodeGroups[0].NodeGroupMembers) > 0 {
+		saved.ReplicasPerNodeGroup = int64(len(group.NodeGroups[0].NodeGroupMembers) - 1)
+	}
+
+	// Network and parameter settings are only reported on the member clusters.
+	cResp, err := fw.elasticache.DescribeCacheClusters(
+		&elasticache.DescribeCacheClustersInput{
+			CacheClusterId: group.MemberClusters[0],
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, cluster := range cResp.CacheClusters {
+		saved.SubnetGroupName = aws.StringValue(cluster.CacheSubnetGroupName)
+		if cluster.CacheParameterGroup != nil {
+			saved.ParameterGroupName = aws.StringValue(cluster.CacheParameterGroup.CacheParameterGroupName)
+		}
+		for _, sg := range cluster.SecurityGroups {
+			saved.SecurityGroupIds = append(saved.SecurityGroupIds, aws.StringValue(sg.SecurityGroupId))
+		}
+	}
+
+	return saved, nil
+}
+
+// elastiCacheAuthToken - the AUTH token of a replication group, from the
+// environment variable configured for it
+func (fw *Flywheel) elastiCacheAuthToken(groupID string) (string, error) {
+	name, ok := fw.config.ElastiCache.AuthTokens[groupID]
+	if !ok {
+		return "", fmt.Errorf("ElastiCache group %s uses an AUTH token, but no auth-tokens variable is configured for it", groupID)
+	}
+	token := os.Getenv(name)
+	if token == "" {
+		return "", fmt.Errorf("Environment variable %s with the AUTH token of ElastiCache group %s is not set", name, groupID)
+	}
+	return token, nil
+}
+
+func (fw *Flywheel) checkElastiCache(health map[string]int) error {
+	for _, groupID := range fw.config.ElastiCache.Snapshot {
+		resp, err := fw.elasticache.DescribeReplicationGroups(
+			&elasticache.DescribeReplicationGroupsInput{
+				ReplicationGroupId: aws.String(groupID),
+			},
+		)
+		if isAwsError(err, elasticache.ErrCodeReplicationGroupNotFoundFault) {
+			// Deleted groups are stopped once their snapshot is complete
+			state, err := fw.checkElastiCacheSnapshot(groupID)
+			if err != nil {
+				return err
+			}
+			health[state] = health[state] + 1
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, group := range resp.ReplicationGroups {
+			state, ok := elastiCacheStates[*group.Status]
+			if !ok {
+				state = *group.Status
+			}
+			health[state] = health[state] + 1
+		}
+	}
+	return nil
+}
+
+func (fw *Flywheel) checkElastiCacheSnapshot(groupID string) (string, error) {
+	resp, err := fw.elasticache.DescribeSnapshots(
+		&elasticache.DescribeSnapshotsInput{
+			SnapshotName: aws.String(elastiCacheSnapshotName(groupID)),
+		},
+	)
+	if err != nil && !isAwsError(err, elasticache.ErrCodeSnapshotNotFoundFault) {
+		return "", err
+	}
+	if err != nil || len(resp.Snapshots) == 0 {
+		return "", fmt.Errorf("ElastiCache group %s and its snapshot are missing", groupID)
+	}
+
+	switch *resp.Snapshots[0].SnapshotStatus {
+	case "available":
+		return "stopped", nil
+	case "creating":
+		return "stopping", nil
+	default:
+		return *resp.Snapshots[0].SnapshotStatus, nil
+	}
+}
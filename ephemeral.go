@@ -0,0 +1,333 @@
+package flywheel
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// EphemeralTag - tag set on instances launched by flywheel, with the name of
+// the ephemeral group as value
+const EphemeralTag = "flywheel:ephemeral"
+
+// EphemeralInstance - an instance launched by flywheel, and the snapshots of
+// its data volumes once terminated
+type EphemeralInstance struct {
+	InstanceID  string            `json:"instance-id,omitempty"`
+	Terminating bool              `json:"terminating,omitempty"`
+	Volumes     []EphemeralVolume `json:"volumes,omitempty"`
+}
+
+// EphemeralVolume - snapshot of a data volume to restore on the next launch
+type EphemeralVolume struct {
+	Device     string `json:"device"`
+	SnapshotID string `json:"snapshot-id"`
+	VolumeType string `json:"volume-type,omitempty"`
+}
+
+// Launch the ephemeral instances, restoring data volumes from the snapshots
+// taken when they were terminated. Instances are launched one at a time, as
+// each has its own snapshots, and only for the slots without one.
+func (fw *Flywheel) launchEphemeral() error {
+	for name, cfg := range fw.config.Ephemeral {
+		fw.stateLock.Lock()
+		previous := fw.state.Ephemeral[name]
+		fw.stateLock.Unlock()
+
+		// Slots still running an instance are kept, so a retried start
+		// only launches the missing ones
+		instances := append([]EphemeralInstance(nil), previous...)
+		for len(instances) < cfg.Count {
+			instances = append(instances, EphemeralInstance{})
+		}
+
+		for i := 0; i < cfg.Count; i++ {
+			if instances[i].InstanceID != "" && !instances[i].Terminating {
+				continue
+			}
+			instances[i].Terminating = false
+			input := ephemeralRunInput(name, &cfg, instances[i].Volumes)
+			resp, err := fw.ec2.RunInstances(input)
+			if err != nil {
+				return err
+			}
+			instances[i].InstanceID = *resp.Instances[0].InstanceId
+			log.Printf("Launched instance %s for %s", instances[i].InstanceID, name)
+
+			// Keep track of each instance as soon as it exists, so a
+			// failure doesn't leave untracked instances running.
+			fw.setEphemeral(name, instances)
+			fw.persist()
+		}
+	}
+	return nil
+}
+
+func ephemeralRunInput(name string, cfg *Ephemeral, volumes []EphemeralVolume) *ec2.RunInstancesInput {
+	input := &ec2.RunInstancesInput{
+		MinCount: aws.Int64(1),
+		MaxCount: aws.Int64(1),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String(ec2.ResourceTypeInstance),
+				Tags: []*ec2.Tag{
+					{Key: aws.String(EphemeralTag), Value: aws.String(name)},
+				},
+			},
+		},
+	}
+
+	if cfg.LaunchTemplate != "" {
+		input.LaunchTemplate = &ec2.LaunchTemplateSpecification{
+			LaunchTemplateName: aws.String(cfg.LaunchTemplate),
+			Version:            aws.String(cfg.LaunchTemplateVersion),
+		}
+	}
+	if cfg.ImageID != "" {
+		input.ImageId = aws.String(cfg.ImageID)
+	}
+	if cfg.InstanceType != "" {
+		input.InstanceType = aws.String(cfg.InstanceType)
+	}
+	if cfg.SubnetID != "" {
+		input.SubnetId = aws.String(cfg.SubnetID)
+	}
+	if len(cfg.SecurityGroupIds) > 0 {
+		input.SecurityGroupIds = aws.StringSlice(cfg.SecurityGroupIds)
+	}
+
+	for _, volume := range volumes {
+		ebs := &ec2.EbsBlockDevice{
+			SnapshotId:          aws.String(volume.SnapshotID),
+			DeleteOnTermination: aws.Bool(true),
+		}
+		if volume.VolumeType != "" {
+			ebs.VolumeType = aws.String(volume.VolumeType)
+		}
+		input.BlockDeviceMappings = append(input.BlockDeviceMappings, &ec2.BlockDeviceMapping{
+			DeviceName: aws.String(volume.Device),
+			Ebs:        ebs,
+		})
+	}
+	return input
+}
+
+// Terminate the ephemeral instances, snapshotting their data volumes first.
+// A snapshot is taken at the time it is requested, so the volumes can be
+// deleted with the instance while the snapshot completes.
+func (fw *Flywheel) terminateEphemeral() error {
+	for name, cfg := range fw.config.Ephemeral {
+		fw.stateLock.Lock()
+		instances := append([]EphemeralInstance(nil), fw.state.Ephemeral[name]...)
+		fw.stateLock.Unlock()
+
+		var instanceIds []*string
+		var replaced []EphemeralVolume
+		for i := range instances {
+			if instances[i].InstanceID == "" {
+				continue
+			}
+			instanceIds = append(instanceIds, aws.String(instances[i].InstanceID))
+
+			if len(cfg.SnapshotVolumes) == 0 {
+				continue
+			}
+			volumes, err := fw.snapshotVolumes(instances[i].InstanceID, cfg.SnapshotVolumes)
+			if err != nil {
+				return err
+			}
+			replaced = append(replaced, instances[i].Volumes...)
+			instances[i].Volumes = volumes
+
+			// Keep track of the new snapshots before anything else can
+			// fail, the replaced ones are still kept until terminated
+			fw.setEphemeral(name, instances)
+			fw.persist()
+		}
+		if len(instanceIds) == 0 {
+			continue
+		}
+
+		log.Printf("Terminating instances %v for %s", aws.StringValueSlice(instanceIds), name)
+		_, err := fw.ec2.TerminateInstances(
+			&ec2.TerminateInstancesInput{
+				InstanceIds: instanceIds,
+			},
+		)
+		if err != nil {
+			return err
+		}
+		for i := range instances {
+			instances[i].Terminating = instances[i].InstanceID != ""
+		}
+		fw.setEphemeral(name, instances)
+		fw.persist()
+
+		for _, volume := range replaced {
+			fw.deleteSnapshot(volume.SnapshotID)
+		}
+	}
+	return nil
+}
+
+// snapshotVolumes - snapshot the volumes attached to the given devices
+func (fw *Flywheel) snapshotVolumes(instanceID string, devices []string) ([]EphemeralVolume, error) {
+	resp, err := fw.ec2.DescribeInstances(
+		&ec2.DescribeInstancesInput{
+			InstanceIds: []*string{aws.String(instanceID)},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
+		return nil, fmt.Errorf("Instance %s not found", instanceID)
+	}
+	instance := resp.Reservations[0].Instances[0]
+
+	var volumes []EphemeralVolume
+	for _, device := range devices {
+		var volumeID *string
+		for _, mapping := range instance.BlockDeviceMappings {
+			if *mapping.DeviceName == device && mapping.Ebs != nil {
+				volumeID = mapping.Ebs.VolumeId
+			}
+		}
+		if volumeID == nil {
+			log.Printf("No volume attached to %s of instance %s, not snapshotting it", device, instanceID)
+			continue
+		}
+
+		vResp, err := fw.ec2.DescribeVolumes(
+			&ec2.DescribeVolumesInput{
+				VolumeIds: []*string{volumeID},
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		var volumeType string
+		if len(vResp.Volumes) > 0 {
+			volumeType = aws.StringValue(vResp.Volumes[0].VolumeType)
+		}
+
+		log.Printf("Snapshotting volume %s (%s) of instance %s", *volumeID, device, instanceID)
+		snapshot, err := fw.ec2.CreateSnapshot(
+			&ec2.CreateSnapshotInput{
+				VolumeId:    volumeID,
+				Description: aws.String(fmt.Sprintf("flywheel: %s of %s", device, instanceID)),
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, EphemeralVolume{
+			Device:     device,
+			SnapshotID: *snapshot.SnapshotId,
+			VolumeType: volumeType,
+		})
+	}
+	return volumes, nil
+}
+
+// deleteSnapshot - drop a snapshot that is no longer needed. Failures only
+// leave an old snapshot behind, so they are logged and ignored.
+func (fw *Flywheel) deleteSnapshot(snapshotID string) {
+	_, err := fw.ec2.DeleteSnapshot(
+		&ec2.DeleteSnapshotInput{
+			SnapshotId: aws.String(snapshotID),
+		},
+	)
+	if err != nil {
+		log.Printf("Unable to delete old snapshot %s: %v", snapshotID, err)
+	}
+}
+
+func (fw *Flywheel) setEphemeral(name string, instances []EphemeralInstance) {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	if fw.state.Ephemeral == nil {
+		fw.state.Ephemeral = make(map[string][]EphemeralInstance)
+	}
+	fw.state.Ephemeral[name] = append([]EphemeralInstance(nil), instances...)
+}
+
+// ephemeralInstanceIds - ids of the instances launched for the ephemeral groups
+func (fw *Flywheel) ephemeralInstanceIds() []*string {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	var instanceIds []*string
+	for _, instances := range fw.state.Ephemeral {
+		for _, instance := range instances {
+			if instance.InstanceID != "" {
+				instanceIds = append(instanceIds, aws.String(instance.InstanceID))
+			}
+		}
+	}
+	return instanceIds
+}
+
+// checkEphemeral - terminated ephemeral instances are stopped as far as
+// flywheel is concerned, and are forgotten so the next start launches new
+// ones. With no instances launched, the group is stopped.
+func (fw *Flywheel) checkEphemeral(health map[string]int) error {
+	if len(fw.config.Ephemeral) == 0 {
+		return nil
+	}
+
+	instanceIds := fw.ephemeralInstanceIds()
+	if len(instanceIds) == 0 {
+		health["stopped"]++
+		return nil
+	}
+
+	// Filter rather than ask for the ids, as terminated instances
+	// eventually disappear and new ones take a moment to show up.
+	resp, err := fw.ec2.DescribeInstances(
+		&ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{
+				{
+					Name:   aws.String("instance-id"),
+					Values: instanceIds,
+				},
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	states := make(map[string]string)
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			states[*instance.InstanceId] = *instance.State.Name
+		}
+	}
+
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	for _, instances := range fw.state.Ephemeral {
+		for i := range instances {
+			if instances[i].InstanceID == "" {
+				continue
+			}
+
+			state, ok := states[instances[i].InstanceID]
+			switch {
+			case !ok && !instances[i].Terminating:
+				state = "pending"
+			case !ok, state == "terminated":
+				instances[i].InstanceID = ""
+				instances[i].Terminating = false
+				state = "stopped"
+			}
+			health[state] = health[state] + 1
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package flywheel
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// InstanceTypeFallback - an instance started as one of its fallback instance
+// types because EC2 had no capacity for its own type
+type InstanceTypeFallback struct {
+	Original string `json:"original"`
+	Current  string `json:"current"`
+}
+
+// startWithFallback - start instances one at a time, moving the ones EC2 has
+// no capacity for to their fallback instance types in turn
+func (fw *Flywheel) startWithFallback(instanceIds []string) error {
+	for _, instanceID := range instanceIds {
+		err := fw.startEC2Instances([]*string{aws.String(instanceID)})
+		for _, instanceType := range fw.config.Fallbacks[instanceID] {
+			if _, ok := err.(*CapacityError); !ok {
+				break
+			}
+
+			log.Printf("%v. Changing instance %s to type %s", err, instanceID, instanceType)
+			err = fw.setInstanceType(instanceID, instanceType)
+			if err != nil {
+				return err
+			}
+			err = fw.startEC2Instances([]*string{aws.String(instanceID)})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setInstanceType - change the type of a stopped instance, remembering its
+// original type
+func (fw *Flywheel) setInstanceType(instanceID, instanceType string) error {
+	fw.stateLock.Lock()
+	fallback, ok := fw.state.InstanceTypes[instanceID]
+	fw.stateLock.Unlock()
+
+	if !ok {
+		resp, err := fw.ec2.DescribeInstanceAttribute(
+			&ec2.DescribeInstanceAttributeInput{
+				InstanceId: aws.String(instanceID),
+				Attribute:  aws.String(ec2.InstanceAttributeNameInstanceType),
+			},
+		)
+		if err != nil {
+			return err
+		}
+		fallback.Original = aws.StringValue(resp.InstanceType.Value)
+	}
+
+	_, err := fw.ec2.ModifyInstanceAttribute(
+		&ec2.ModifyInstanceAttributeInput{
+			InstanceId:   aws.String(instanceID),
+			InstanceType: &ec2.AttributeValue{Value: aws.String(instanceType)},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	fallback.Current = instanceType
+	fw.stateLock.Lock()
+	if fw.state.InstanceTypes == nil {
+		fw.state.InstanceTypes = make(map[string]InstanceTypeFallback)
+	}
+	fw.state.InstanceTypes[instanceID] = fallback
+	fw.stateLock.Unlock()
+	return nil
+}
+
+// restoreInstanceTypes - move instances started as a fallback type back to
+// their original type, so every start tries the preferred type first. The
+// instances have to be stopped.
+func (fw *Flywheel) restoreInstanceTypes() error {
+	fw.stateLock.Lock()
+	fallbacks := make(map[string]InstanceTypeFallback, len(fw.state.InstanceTypes))
+	for instanceID, fallback := range fw.state.InstanceTypes {
+		fallbacks[instanceID] = fallback
+	}
+	fw.stateLock.Unlock()
+
+	for instanceID, fallback := range fallbacks {
+		log.Printf("Restoring instance %s to type %s", instanceID, fallback.Original)
+		_, err := fw.ec2.ModifyInstanceAttribute(
+			&ec2.ModifyInstanceAttributeInput{
+				InstanceId:   aws.String(instanceID),
+				InstanceType: &ec2.AttributeValue{Value: aws.String(fallback.Original)},
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		fw.stateLock.Lock()
+		delete(fw.state.InstanceTypes, instanceID)
+		fw.stateLock.Unlock()
+	}
+	return nil
+}
+
+// fallbackInstanceTypes - the instances currently running as a fallback type,
+// for the status
+func (fw *Flywheel) fallbackInstanceTypes() map[string]string {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	if len(fw.state.InstanceTypes) == 0 {
+		return nil
+	}
+	types := make(map[string]string, len(fw.state.InstanceTypes))
+	for instanceID, fallback := range fw.state.InstanceTypes {
+		types[instanceID] = fallback.Current
+	}
+	return types
+}
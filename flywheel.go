@@ -1,16 +1,24 @@
 package flywheel
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/redshift"
+	"github.com/aws/aws-sdk-go/service/route53"
 )
 
 // SpinINTERVAL determines how often flywheel will update its
@@ -29,12 +37,42 @@ type Ping struct {
 
 // Pong - result of the ping request
 type Pong struct {
-	Status      Status    `json:"-"`
-	StatusName  string    `json:"status"`
-	Err         error     `json:"error,omitempty"`
-	LastStarted time.Time `json:"last-started,omitempty"`
-	LastStopped time.Time `json:"last-stopped,omitempty"`
-	StopAt      time.Time `json:"stop-due-at"`
+	Status      Status            `json:"-"`
+	StatusName  string            `json:"status"`
+	Err         error             `json:"error,omitempty"`
+	LastStarted time.Time         `json:"last-started,omitempty"`
+	LastStopped time.Time         `json:"last-stopped,omitempty"`
+	StopAt      time.Time         `json:"stop-due-at"`
+	Fallbacks   map[string]string `json:"instance-type-fallbacks,omitempty"`
+	Downsized   bool              `json:"downsized,omitempty"`
+	IdleStage   string            `json:"idle-stage,omitempty"`
+	Restoring   time.Time         `json:"restoring-volumes-since,omitempty"`
+	State       *State            `json:"state,omitempty"`
+}
+
+// State - details about the managed resources that flywheel needs to
+// remember between a stop and the next start. Saved in the status file.
+type State struct {
+	AutoScaling        map[string]AutoScalingCapacity  `json:"autoscaling,omitempty"`
+	SuspendedProcesses map[string][]string             `json:"suspended-processes,omitempty"`
+	Standby            map[string][]string             `json:"standby,omitempty"`
+	OnDemandPercentage map[string]int64                `json:"on-demand-percentage,omitempty"`
+	InstanceTypes      map[string]InstanceTypeFallback `json:"instance-types,omitempty"`
+	Downsized          map[string]string               `json:"downsized,omitempty"`
+	Resizing           map[string]string               `json:"resizing,omitempty"`
+	IdleStage          int                             `json:"idle-stage,omitempty"`
+	IdleCapacity       map[string]AutoScalingCapacity  `json:"idle-capacity,omitempty"`
+	ElastiCache        map[string]ElastiCacheGroup     `json:"elasticache,omitempty"`
+	Ephemeral          map[string][]EphemeralInstance  `json:"ephemeral,omitempty"`
+	Volumes            map[string][]ReleasedVolume     `json:"released-volumes,omitempty"`
+	Restoring          time.Time                       `json:"restoring-volumes-since,omitempty"`
+}
+
+// AutoScalingCapacity - size of an autoscaling group before it was terminated
+type AutoScalingCapacity struct {
+	MinSize         int64 `json:"min-size"`
+	MaxSize         int64 `json:"max-size"`
+	DesiredCapacity int64 `json:"desired-capacity"`
 }
 
 // Flywheel struct holds all the state required by the flywheel goroutine.
@@ -45,12 +83,43 @@ type Flywheel struct {
 	status      Status
 	ready       bool
 	stopAt      time.Time
+	lastActive  time.Time
 	lastStarted time.Time
 	lastStopped time.Time
 	ec2         *ec2.EC2
 	autoscaling *autoscaling.AutoScaling
+	redshift    *redshift.Redshift
+	elasticache *elasticache.ElastiCache
+	route53     *route53.Route53
+	elbv2       *elbv2.ELBV2
+	backends    balancer
+	tunnels     tunnels
+	state       State
+	stateLock   sync.Mutex
 	hcInterval  time.Duration
 	idleTimeout time.Duration
+
+	// Targets deregistered by Stop, guarded by stateLock
+	deregistered bool
+
+	// Load scaling counters, updated by the http handlers
+	requests        uint64
+	connections     int64
+	peakConnections int64
+	lastScaled      time.Time
+
+	// Next attempt at releasing the volumes of stopped instances
+	releaseAt time.Time
+
+	// Pending Route53 changes by record name, used by the healthcheck
+	recordChanges map[string]string
+
+	// Status found by the last healthcheck, used by the healthcheck
+	checked Status
+
+	// Status file the state is saved to, and what was last written to it
+	statusFile string
+	persisted  []byte
 }
 
 // New - Create new Flywheel type
@@ -67,6 +136,11 @@ func New(config *Config) *Flywheel {
 		stopAt:      time.Now(),
 		ec2:         ec2.New(sess),
 		autoscaling: autoscaling.New(sess),
+		redshift:    redshift.New(sess),
+		elasticache: elasticache.New(sess),
+		route53:     route53.New(sess),
+		elbv2:       elbv2.New(sess),
+		backends:    balancer{mode: config.Backends.Balance},
 	}
 }
 
@@ -100,11 +174,13 @@ func (fw *Flywheel) Spin() {
 				// If there is an active timeout, keep it instead of resetting.
 				if status == STARTED && fw.stopAt.Before(time.Now()) {
 					fw.stopAt = time.Now().Add(fw.idleTimeout)
+					fw.lastActive = time.Now()
 					log.Printf("Timer update. Stop scheduled for %v", fw.stopAt)
 				}
 				fw.status = status
 			}
 		}
+		fw.persist()
 	}
 }
 
@@ -126,11 +202,19 @@ func (fw *Flywheel) RecvPing(ping *Ping) {
 			// Status requests, etc. Don't update idle timer
 		} else if ping.requestStop {
 			pong.Err = fw.Stop()
+		} else if fw.downsized() {
+			pong.Err = fw.Upsize()
+		} else if fw.idleStage() != "" {
+			pong.Err = fw.restoreIdleStages()
+			fw.stopAt = time.Now().Add(fw.idleTimeout)
+			fw.lastActive = time.Now()
 		} else if int64(ping.setTimeout) != 0 {
 			fw.stopAt = time.Now().Add(ping.setTimeout)
+			fw.lastActive = time.Now()
 			log.Printf("Timer update. Stop scheduled for %v", fw.stopAt)
 		} else {
 			fw.stopAt = time.Now().Add(fw.idleTimeout)
+			fw.lastActive = time.Now()
 			log.Printf("Timer update. Stop scheduled for %v", fw.stopAt)
 		}
 	}
@@ -140,6 +224,10 @@ func (fw *Flywheel) RecvPing(ping *Ping) {
 	pong.LastStarted = fw.lastStarted
 	pong.LastStopped = fw.lastStopped
 	pong.StopAt = fw.stopAt
+	pong.Fallbacks = fw.fallbackInstanceTypes()
+	pong.Downsized = fw.downsized()
+	pong.IdleStage = fw.idleStage()
+	pong.Restoring = fw.restoringSince()
 
 	ch <- pong
 }
@@ -149,12 +237,44 @@ func (fw *Flywheel) RecvPing(ping *Ping) {
 func (fw *Flywheel) Poll() {
 	switch fw.status {
 	case STARTED:
+		if fw.tunnels.count() > 0 {
+			// Open upgraded connections, e.g. WebSockets, are activity
+			fw.stopAt = time.Now().Add(fw.idleTimeout)
+			fw.lastActive = time.Now()
+		}
+		if len(fw.config.IdleStages) > 0 {
+			fw.checkIdleStages()
+		}
+		if len(fw.config.LoadScaling) > 0 {
+			fw.checkLoad()
+		}
 		if time.Now().After(fw.stopAt) {
+			if fw.config.IdleAction == IdleDownsize {
+				if !fw.downsized() {
+					log.Print("Idle timeout - downsizing")
+					if err := fw.Downsize(); err != nil {
+						// try again after the next healthcheck
+						fw.stopAt = time.Now().Add(fw.hcInterval)
+					}
+				}
+				return
+			}
 			fw.Stop()
 			log.Print("Idle timeout - shutting down")
 			fw.status = STOPPING
 		}
 
+	case STOPPED:
+		if fw.config.Release > 0 && !fw.lastStopped.IsZero() && !fw.volumesReleased() &&
+			time.Since(fw.lastStopped) >= time.Duration(fw.config.Release) && time.Now().After(fw.releaseAt) {
+			log.Printf("Stopped since %v - releasing data volumes", fw.lastStopped)
+			if err := fw.releaseVolumes(); err != nil {
+				log.Printf("Error releasing volumes: %v", err)
+				// try again after the next healthcheck
+				fw.releaseAt = time.Now().Add(fw.hcInterval)
+			}
+		}
+
 	case STOPPING:
 		if fw.ready {
 			log.Print("Shutdown complete")
@@ -165,42 +285,91 @@ func (fw *Flywheel) Poll() {
 		if fw.ready {
 			fw.status = STARTED
 			fw.stopAt = time.Now().Add(fw.idleTimeout)
+			fw.lastActive = time.Now()
 			log.Printf("Startup complete. Stop scheduled for %v", fw.stopAt)
 		}
 	}
 }
 
 // WriteStatusFile - Before we exit the application we write the current state
+// Not safe while Spin runs, which saves the status file itself.
 func (fw *Flywheel) WriteStatusFile(statusFile string) {
-	var pong Pong
+	buf, err := fw.statusJSON()
+	if err == nil {
+		err = writeFileAtomic(statusFile, buf)
+	}
+	if err != nil {
+		log.Printf("Unable to write status file: %s", err)
+	}
+}
 
-	fd, err := os.OpenFile(statusFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+// persist - save the status file whenever the state changed since it was
+// last written, so it survives a crash. Called from the Spin goroutine.
+func (fw *Flywheel) persist() {
+	if fw.statusFile == "" {
+		return
+	}
+	buf, err := fw.statusJSON()
 	if err != nil {
 		log.Printf("Unable to write status file: %s", err)
 		return
 	}
-	defer fd.Close()
+	if bytes.Equal(buf, fw.persisted) {
+		return
+	}
+
+	err = writeFileAtomic(fw.statusFile, buf)
+	if err != nil {
+		log.Printf("Unable to write status file: %s", err)
+		return
+	}
+	fw.persisted = buf
+}
+
+func (fw *Flywheel) statusJSON() ([]byte, error) {
+	var pong Pong
 
 	pong.Status = fw.status
 	pong.StatusName = fw.status.String()
 	pong.LastStarted = fw.lastStarted
 	pong.LastStopped = fw.lastStopped
+	pong.State = &fw.state
+
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+	return json.Marshal(pong)
+}
 
-	buf, err := json.Marshal(pong)
+// writeFileAtomic - replace a file through a temporary file, so it is never
+// left half written
+func writeFileAtomic(name string, buf []byte) error {
+	fd, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
 	if err != nil {
-		log.Printf("Unable to write status file: %s", err)
-		return
+		return err
 	}
+	defer os.Remove(fd.Name())
 
 	_, err = fd.Write(buf)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(fd.Name(), 0644)
+	}
 	if err != nil {
-		log.Printf("Unable to write status file: %s", err)
-		return
+		return err
 	}
+	return os.Rename(fd.Name(), name)
 }
 
-// ReadStatusFile load status from the status file
+// ReadStatusFile load status from the status file. Changes to the state are
+// saved to it from then on.
 func (fw *Flywheel) ReadStatusFile(statusFile string) {
+	fw.statusFile = statusFile
+
 	fd, err := os.Open(statusFile)
 	if err != nil {
 		if err != os.ErrNotExist {
@@ -232,4 +401,7 @@ func (fw *Flywheel) ReadStatusFile(statusFile string) {
 	fw.status = status.Status
 	fw.lastStarted = status.LastStarted
 	fw.lastStopped = status.LastStopped
+	if status.State != nil {
+		fw.state = *status.State
+	}
 }
@@ -0,0 +1,40 @@
+package flywheel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestPersistState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flywheel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statusFile := filepath.Join(dir, "status.json")
+
+	fw := &Flywheel{config: &Config{}}
+	fw.ReadStatusFile(statusFile)
+	fw.saveCapacity(&autoscaling.Group{
+		AutoScalingGroupName: aws.String("web"),
+		MinSize:              aws.Int64(1),
+		MaxSize:              aws.Int64(4),
+		DesiredCapacity:      aws.Int64(2),
+	})
+
+	restored := &Flywheel{config: &Config{}}
+	restored.ReadStatusFile(statusFile)
+	if capacity, ok := restored.savedCapacity("web"); !ok || capacity.DesiredCapacity != 2 {
+		t.Errorf("Expexted the saved capacity to be persisted, but got %v", restored.state.AutoScaling)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expexted only the status file to be left, but got %d files", len(files))
+	}
+}
@@ -0,0 +1,52 @@
+package flywheel
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// gRPC status codes answered by flywheel itself
+const (
+	GRPCInternal    = 13
+	GRPCUnavailable = 14
+)
+
+// isGRPC - check if a request is a gRPC call
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// writeGRPCStatus - answer a gRPC call while the environment isn't started,
+// as a trailers-only response. The flywheel-status metadata holds the status
+// of the environment; start it with ?flywheel=start like any other request.
+func writeGRPCStatus(w http.ResponseWriter, pong Pong) {
+	code := GRPCUnavailable
+	message := fmt.Sprintf("Environment is %s", pong.StatusName)
+	if pong.Err != nil {
+		message = pong.Err.Error()
+		if _, ok := pong.Err.(*CapacityError); !ok {
+			code = GRPCInternal
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", fmt.Sprint(code))
+	w.Header().Set("Grpc-Message", grpcEscape(message))
+	w.Header().Set("Flywheel-Status", pong.StatusName)
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcEscape - percent-encode a grpc-message as the gRPC protocol requires
+func grpcEscape(message string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		} else {
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
@@ -2,6 +2,7 @@ package flywheel
 
 import (
 	"log"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -43,13 +44,15 @@ func (n Status) String() string {
 // HealthWatcher - Check the status of the instances. Currently checks if they are "ready"; all
 // stopped or all started. Will need to be extended to determine actual status.
 func (fw *Flywheel) HealthWatcher(out chan<- Status) {
-	out <- fw.CheckAll()
+	fw.checked = fw.CheckAll()
+	out <- fw.checked
 
 	ticker := time.NewTicker(fw.hcInterval)
 	for {
 		select {
 		case <-ticker.C:
-			out <- fw.CheckAll()
+			fw.checked = fw.CheckAll()
+			out <- fw.checked
 		}
 	}
 }
@@ -71,6 +74,67 @@ func (fw *Flywheel) CheckAll() Status {
 		return UNHEALTHY
 	}
 
+	err = fw.checkTerminatedAutoScalingGroups(health)
+	if err != nil {
+		log.Print(err)
+		return UNHEALTHY
+	}
+
+	err = fw.checkStandbyAutoScalingGroups(health)
+	if err != nil {
+		log.Print(err)
+		return UNHEALTHY
+	}
+
+	err = fw.checkWarmPoolAutoScalingGroups(health)
+	if err != nil {
+		log.Print(err)
+		return UNHEALTHY
+	}
+
+	err = fw.checkRedshift(health)
+	if err != nil {
+		log.Print(err)
+		return UNHEALTHY
+	}
+
+	err = fw.checkElastiCache(health)
+	if err != nil {
+		log.Print(err)
+		return UNHEALTHY
+	}
+
+	err = fw.checkEphemeral(health)
+	if err != nil {
+		log.Print(err)
+		return UNHEALTHY
+	}
+
+	err = fw.checkAddresses(health)
+	if err != nil {
+		log.Print(err)
+		return UNHEALTHY
+	}
+
+	err = fw.checkTargetGroups(health)
+	if err != nil {
+		log.Print(err)
+		return UNHEALTHY
+	}
+
+	if fw.config.Backends.Port > 0 {
+		err = fw.refreshBackends()
+		if err != nil {
+			log.Printf("Error refreshing backends: %v", err)
+		}
+	}
+
+	return healthStatus(health)
+}
+
+// healthStatus - the status of the environment from the counts of its
+// resources by state
+func healthStatus(health map[string]int) Status {
 	_, terminated := health["terminated"]
 	_, starting := health["pending"]
 	_, stopping := health["stopping"]
@@ -125,7 +189,13 @@ func (fw *Flywheel) checkInstances(health map[string]int) error {
 
 	for _, reservation := range resp.Reservations {
 		for _, instance := range reservation.Instances {
-			state := *instance.State.Name
+			state, err := fw.checkResizing(instance)
+			if err == nil {
+				state, err = fw.checkReleasedVolumes(instance, state)
+			}
+			if err != nil {
+				return err
+			}
 			health[state] = health[state] + 1
 		}
 	}
@@ -179,9 +249,13 @@ func (fw *Flywheel) checkStoppedAutoScalingGroups(health map[string]int) error {
 			}
 		}
 
-		// if all instances are running and ASG is suspended
-		// resume the group
-		if running && len(group.SuspendedProcesses) > 0 {
+		// if all instances are running and flywheel suspended processes
+		// in the ASG, resume them
+		fw.stateLock.Lock()
+		processes := fw.state.SuspendedProcesses[*group.AutoScalingGroupName]
+		fw.stateLock.Unlock()
+
+		if running && len(processes) > 0 {
 			for _, instance := range group.Instances {
 				fw.autoscaling.SetInstanceHealth(
 					&autoscaling.SetInstanceHealthInput{
@@ -191,27 +265,99 @@ func (fw *Flywheel) checkStoppedAutoScalingGroups(health map[string]int) error {
 				)
 			}
 
+			log.Printf("Resuming %v in autoscaling group %s", processes, *group.AutoScalingGroupName)
 			_, err = fw.autoscaling.ResumeProcesses(
 				&autoscaling.ScalingProcessQuery{
 					AutoScalingGroupName: group.AutoScalingGroupName,
+					ScalingProcesses:     aws.StringSlice(processes),
 				},
 			)
 			if err != nil {
 				return err
 			}
+
+			fw.stateLock.Lock()
+			delete(fw.state.SuspendedProcesses, *group.AutoScalingGroupName)
+			fw.stateLock.Unlock()
 		}
 	}
 
 	return nil
 }
 
-// NOT USED ?
+// scalingIn - instances leaving a group which still has a desired capacity
+// are being scaled in (by an idle stage or a scaling policy), they don't mean
+// the group is stopping.
+func scalingIn(state string) bool {
+	return state == "shutting-down" || state == "stopping"
+}
+
+// countGroupInstances - count the instances of a group with a desired
+// capacity. While the environment is started, a group with healthy instances
+// launching more (load scaling, or an idle stage being restored) is scaling
+// out rather than starting, so its new instances aren't counted. Returns
+// whether instances are still to be launched.
+func countGroupInstances(health map[string]int, group *autoscaling.Group, started bool) bool {
+	scalingOut := false
+	if started {
+		for _, instance := range group.Instances {
+			scalingOut = scalingOut || lifecycleState(instance) == "running"
+		}
+	}
+
+	for _, instance := range group.Instances {
+		state := lifecycleState(instance)
+		if scalingIn(state) || (scalingOut && state == "pending") {
+			continue
+		}
+		health[state] = health[state] + 1
+	}
+
+	// Instances not launched yet
+	missing := *group.DesiredCapacity - int64(len(group.Instances))
+	if missing > 0 && !scalingOut {
+		health["pending"] += int(missing)
+	}
+	return missing > 0
+}
+
+// lifecycleState maps the lifecycle state of an autoscaling group instance to
+// the EC2 instance states used by CheckAll.
+func lifecycleState(instance *autoscaling.Instance) string {
+	state := *instance.LifecycleState
+	switch {
+	case state == autoscaling.LifecycleStateInService:
+		if *instance.HealthStatus != "Healthy" {
+			return "pending"
+		}
+		return "running"
+	case strings.HasPrefix(state, "Pending"):
+		return "pending"
+	case strings.HasPrefix(state, "Terminat"), strings.HasPrefix(state, "Warmed:Terminat"):
+		return "shutting-down"
+	case state == autoscaling.LifecycleStateStandby,
+		state == autoscaling.LifecycleStateWarmedStopped,
+		state == autoscaling.LifecycleStateWarmedHibernated:
+		return "stopped"
+	case strings.HasPrefix(state, "Warmed:"), strings.HasPrefix(state, "EnteringStandby"):
+		return "stopping"
+	default:
+		return state
+	}
+}
+
+// checkTerminatedAutoScalingGroups - groups in terminate mode have no
+// instances to look at while powered down, so use the group size and the
+// lifecycle state of its instances instead of the EC2 state.
 func (fw *Flywheel) checkTerminatedAutoScalingGroups(health map[string]int) error {
-	var err error
 	var awsGroupNames []*string
 
+	if len(fw.config.AutoScaling.Terminate) == 0 {
+		return nil
+	}
+
 	for groupName := range fw.config.AutoScaling.Terminate {
-		awsGroupNames = append(awsGroupNames, &groupName)
+		awsGroupNames = append(awsGroupNames, aws.String(groupName))
 	}
 
 	resp, err := fw.autoscaling.DescribeAutoScalingGroups(
@@ -220,42 +366,25 @@ func (fw *Flywheel) checkTerminatedAutoScalingGroups(health map[string]int) erro
 		},
 	)
 	if err != nil {
-		log.Print(err)
 		return err
 	}
 
 	for _, group := range resp.AutoScalingGroups {
+		// Scaled to zero: any instances left are on their way out
 		if *group.MaxSize == 0 {
 			if len(group.Instances) == 0 {
 				health["stopped"]++
 			} else {
-				health["stopping"]++
+				health["shutting-down"] += len(group.Instances)
 			}
 			continue
 		}
 
-		healthy := true
-		for _, instance := range group.Instances {
-			if *instance.HealthStatus != "Healthy" {
-				healthy = false
-				break
-			}
-		}
-
-		if healthy {
-			health["running"]++
-			if len(group.SuspendedProcesses) > 0 {
-				_, err = fw.autoscaling.ResumeProcesses(
-					&autoscaling.ScalingProcessQuery{
-						AutoScalingGroupName: group.AutoScalingGroupName,
-					},
-				)
-				if err != nil {
-					return err
-				}
+		if countGroupInstances(health, group, fw.checked == STARTED) {
+			err = fw.onDemandFallback(group)
+			if err != nil {
+				return err
 			}
-		} else {
-			health["starting"]++
 		}
 	}
 
@@ -0,0 +1,40 @@
+package flywheel
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestScalingOutStaysStarted(t *testing.T) {
+	group := &autoscaling.Group{
+		DesiredCapacity: aws.Int64(3),
+		Instances: []*autoscaling.Instance{
+			{LifecycleState: aws.String(autoscaling.LifecycleStateInService), HealthStatus: aws.String("Healthy")},
+			{LifecycleState: aws.String(autoscaling.LifecycleStatePending), HealthStatus: aws.String("Healthy")},
+		},
+	}
+
+	health := make(map[string]int)
+	if !countGroupInstances(health, group, true) {
+		t.Errorf("Expexted an instance still to be launched")
+	}
+	if status := healthStatus(health); status != STARTED {
+		t.Errorf("Expexted status STARTED while scaling out, but got %v", status)
+	}
+
+	health = make(map[string]int)
+	countGroupInstances(health, group, false)
+	if status := healthStatus(health); status != STARTING {
+		t.Errorf("Expexted status STARTING while starting, but got %v", status)
+	}
+
+	// Nothing healthy yet, the group is still starting
+	group.Instances[0].HealthStatus = aws.String("Unhealthy")
+	health = make(map[string]int)
+	countGroupInstances(health, group, true)
+	if status := healthStatus(health); status != STARTING {
+		t.Errorf("Expexted status STARTING without healthy instances, but got %v", status)
+	}
+}
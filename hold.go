@@ -0,0 +1,93 @@
+package flywheel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HoldRetryInterval - how often a held request checks whether the environment
+// has started
+const HoldRetryInterval = time.Second
+
+// ErrBodyTooLarge - the body of a held request is over the hold max-body
+var ErrBodyTooLarge = errors.New("Request body too large to hold")
+
+// holds - check if a request waits for the environment to start instead of
+// getting the stopped or starting page, e.g. for API clients and CI jobs.
+// Hostnames match without the port, and path prefixes whole path segments.
+func (handler *Handler) holds(r *http.Request) bool {
+	hold := &handler.Flywheel.config.Hold
+	host := requestHostname(r)
+	for _, hostname := range hold.Vhosts {
+		if strings.EqualFold(hostname, host) {
+			return true
+		}
+	}
+	for _, prefix := range hold.Paths {
+		if _, ok := cutPathPrefix(r.URL.Path, strings.TrimSuffix(prefix, "/")); ok {
+			return true
+		}
+	}
+	return hold.Header != "" && r.Header.Get(hold.Header) != ""
+}
+
+// bufferBody - read the request body, so the client isn't left sending it
+// while the request is held, and it can be proxied once started
+func bufferBody(r *http.Request, max int64) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > max {
+		return ErrBodyTooLarge
+	}
+
+	r.ContentLength = int64(len(body))
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil
+}
+
+// hold - start the environment if it is stopped, and wait until it has
+// started, the hold timeout passes or the client goes away. Returns the last
+// status.
+func (handler *Handler) hold(r *http.Request, pong Pong) Pong {
+	timeout := time.Duration(handler.Flywheel.config.Hold.Timeout)
+	log.Printf("[%s] Holding %s %s until started", r.RemoteAddr, r.Method, r.RequestURI)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(HoldRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		if pong.Status == STOPPED {
+			pong = handler.sendPing("start")
+		}
+		if pong.Err != nil || pong.Status == STARTED || pong.Status == UNHEALTHY {
+			return pong
+		}
+
+		select {
+		case <-r.Context().Done():
+			return pong
+		case <-deadline.C:
+			log.Printf("[%s] Environment did not start within %v", r.RemoteAddr, timeout)
+			return pong
+		case <-ticker.C:
+		}
+		pong = handler.sendPing("")
+	}
+}
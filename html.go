@@ -27,6 +27,21 @@ const HTMLSTARTING = `
 		</body>
 	</html>`
 
+// HTMLRESTORING - display when system is starting, restoring released volumes
+const HTMLRESTORING = `
+	<html>
+		<script>
+			setTimeout(function() {
+				window.location.reload(1);
+			}, 5000);
+		</script>
+		<body style="color: #333333; background: #f5f5f5">
+			<h1 style="text-align: center; margin-top: 50px; font-size: larger;">Your service is starting, please wait.</h1>
+			<p style="text-align: center;">Your site will be loaded once startup is complete.</p>
+			<p style="text-align: center;">Data volumes are being restored from snapshots after a long shutdown, which makes this startup take longer (%v so far).</p>
+		</body>
+	</html>`
+
 // HTMLSTOPPING - display when system is stopping
 const HTMLSTOPPING = `
 	<html>
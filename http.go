@@ -1,14 +1,16 @@
 package flywheel
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
@@ -18,23 +20,25 @@ type Handler struct {
 	Flywheel *Flywheel
 	tmpl     *template.Template
 
-	// HTTPClient is the HTTP client to use when proxying request to the backends
-	// This is used to control redirect behavior.
+	// HTTPClient holds the Transport to use when proxying requests to the
+	// backends. Redirects from the backends are passed on to the client by
+	// the ReverseProxy, the client itself is not used.
 	HTTPClient *http.Client
+
+	// Transports to HTTPS backends with their own TLS settings
+	transports    map[string]http.RoundTripper
+	transportLock sync.Mutex
 }
 
-// ErrIgnoreRedirects used for proxy redirect ignore
-var ErrIgnoreRedirects = errors.New("Ignore Redirect Error")
+// ProxyFlushInterval - how often streamed responses are flushed to the client.
+// Server-sent events are flushed right away.
+const ProxyFlushInterval = 100 * time.Millisecond
 
 // NewHandler create flywheel http handler
 func NewHandler(fw *Flywheel) *Handler {
 	return &Handler{
-		Flywheel: fw,
-		HTTPClient: &http.Client{
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return ErrIgnoreRedirects
-			},
-		},
+		Flywheel:   fw,
+		HTTPClient: &http.Client{},
 	}
 }
 
@@ -69,37 +73,184 @@ func (handler *Handler) sendPing(op string) Pong {
 	return status
 }
 
-// TODO - refactor this function to use context
-// TODO - add support for SSL
 func (handler *Handler) proxy(w http.ResponseWriter, r *http.Request) {
+	defer handler.Flywheel.trackRequest()()
 
-	r.URL.Host = handler.Flywheel.ProxyEndpoint(r.Host)
-	r.URL.Scheme = "http"
-	r.RequestURI = ""
-	r.URL.Query().Del("flywheel")
-
-	resp, err := handler.HTTPClient.Do(r)
+	// Routing rules take over from the vhosts and discovered backends
+	var endpoint string
+	release := func() {}
+	route := handler.Flywheel.Route(r)
+	if route != nil {
+		endpoint = route.Backend
+	} else {
+		endpoint, release = handler.Flywheel.Backend(r.Host)
+	}
+	defer release()
+	if endpoint == "" {
+		log.Printf("No backend for %s", r.Host)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 
+	target, err := ParseTarget(endpoint)
+	var transport http.RoundTripper
+	if err == nil {
+		transport, err = handler.transport(r.Host, target)
+	}
 	if err != nil {
-		if urlError, ok := err.(*url.Error); ok && urlError.Err == ErrIgnoreRedirects {
-			err = nil
-		} else {
+		log.Print(err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// Upgraded connections are tunnelled by the ReverseProxy
+	if isUpgrade(r) {
+		w = &upgradeWriter{ResponseWriter: w, fw: handler.Flywheel}
+	}
+
+	// gRPC streams messages, they can't wait for the next flush
+	flushInterval := ProxyFlushInterval
+	if isGRPC(r) {
+		flushInterval = -1
+	}
+
+	var modifyResponse func(*http.Response) error
+	rw := handler.rewriter(r, target, route)
+	if rw != nil {
+		modifyResponse = rw.modifyResponse
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			req := pr.Out
+			req.URL.Scheme = target.Scheme
+			if target.Scheme == "h2c" {
+				req.URL.Scheme = "http"
+			}
+			req.URL.Host = target.Host
+
+			// Join the escaped paths, so escapes such as %2F reach the
+			// backend as they are
+			if (target.Path != "" && target.Path != "/") || (route != nil && route.Rewrite != "") {
+				path := req.URL.EscapedPath()
+				if route != nil {
+					path = route.rewrite(path)
+				}
+				path = joinPath(target.EscapedPath(), path)
+				if unescaped, err := url.PathUnescape(path); err == nil {
+					req.URL.Path = unescaped
+					req.URL.RawPath = path
+				}
+			}
+
+			query := req.URL.Query()
+			if _, ok := query["flywheel"]; ok {
+				query.Del("flywheel")
+				req.URL.RawQuery = query.Encode()
+			}
+
+			// Let the transport ask for and decompress gzip, so HTML
+			// pages can be rewritten
+			if rw != nil && rw.config.HTML {
+				req.Header.Del("Accept-Encoding")
+			}
+
+			// The ReverseProxy drops the inbound X-Forwarded headers, and
+			// the headers a client names in Connection, before this runs.
+			// Keep the headers from a trusted load balancer in front only,
+			// clients could set anything.
+			trusted := handler.Flywheel.config.TrustProxy
+			if forwarded := pr.In.Header["X-Forwarded-For"]; trusted && len(forwarded) > 0 {
+				req.Header["X-Forwarded-For"] = forwarded
+			}
+			pr.SetXForwarded()
+			if trusted {
+				for _, name := range []string{"X-Forwarded-Host", "X-Forwarded-Proto"} {
+					if value := pr.In.Header.Get(name); value != "" {
+						req.Header.Set(name, value)
+					}
+				}
+			}
+		},
+		Transport:      transport,
+		FlushInterval:  flushInterval,
+		ModifyResponse: modifyResponse,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
 			log.Print(err)
 			w.WriteHeader(http.StatusServiceUnavailable)
-			return
-		}
+		},
 	}
+	proxy.ServeHTTP(w, r)
+}
 
-	for key, value := range resp.Header {
-		w.Header()[key] = value
+// transport - the round tripper to a backend of a vhost, with its timeout
+func (handler *Handler) transport(hostname string, target *url.URL) (http.RoundTripper, error) {
+	transport, err := handler.upstreamTransport(target)
+	if err != nil {
+		return nil, err
 	}
-	w.WriteHeader(resp.StatusCode)
 
-	_, err = io.Copy(w, resp.Body)
-	// if response code is between 300 and 400 sometimes body does not exist
-	if err != nil && (!(resp.StatusCode >= 300 && resp.StatusCode < 400)) {
-		log.Print(err)
+	timeout, ok := handler.Flywheel.config.Timeouts[hostname]
+	if !ok {
+		timeout = handler.Flywheel.config.Timeout
 	}
+	if timeout <= 0 {
+		return transport, nil
+	}
+	return &timeoutTransport{RoundTripper: transport, timeout: time.Duration(timeout)}, nil
+}
+
+// timeoutTransport - gives up on backends which don't send the response
+// headers in time. Streaming the body afterwards isn't limited.
+type timeoutTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(r.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+
+	resp, err := t.RoundTripper.RoundTrip(r.WithContext(ctx))
+	if !timer.Stop() && err != nil {
+		err = fmt.Errorf("No response from %s within %v: %v", r.URL.Host, t.timeout, err)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if body, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		// The tunnel writes to the body, keep it writable
+		resp.Body = &cancelConn{ReadWriteCloser: body, cancel: cancel}
+		return resp, nil
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody - release the request context once the body is done with
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// cancelConn - release the request context once an upgraded connection is
+// done with
+type cancelConn struct {
+	io.ReadWriteCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.cancel()
+	return err
 }
 
 func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -164,8 +315,34 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if pong.Err == nil && pong.Status != STARTED && handler.holds(r) {
+		// gRPC streams the request body, it can't be buffered
+		if !isGRPC(r) {
+			if err := bufferBody(r, handler.Flywheel.config.Hold.MaxBody); err != nil {
+				log.Printf("[%s] %v", r.RemoteAddr, err)
+				if err == ErrBodyTooLarge {
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+				} else {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+				return
+			}
+		}
+		pong = handler.hold(r, pong)
+	}
+
+	if isGRPC(r) && (pong.Err != nil || pong.Status != STARTED) {
+		writeGRPCStatus(w, pong)
+		return
+	}
+
 	if pong.Err != nil {
 		body := fmt.Sprintf(HTMLERROR, pong.Err)
+		if _, ok := pong.Err.(*CapacityError); ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(body))
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(body))
 		return
@@ -180,6 +357,10 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(body))
 	case STARTING:
 		w.WriteHeader(http.StatusServiceUnavailable)
+		if !pong.Restoring.IsZero() {
+			fmt.Fprintf(w, HTMLRESTORING, time.Since(pong.Restoring).Round(time.Second))
+			return
+		}
 		w.Write([]byte(HTMLSTARTING))
 	case STARTED:
 		handler.proxy(w, r)
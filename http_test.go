@@ -1,12 +1,20 @@
 package flywheel
 
 import (
+	"bufio"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 // MockedHandler to verify if non 200 http codes return unmodified values
@@ -89,3 +97,563 @@ func TestProxyFunction(t *testing.T) {
 		}
 	}
 }
+
+func TestProxyTracksLoad(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(MockedHandler))
+	defer server.Close()
+
+	fw := Flywheel{
+		config: &Config{
+			Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		},
+	}
+	handler := NewHandler(&fw)
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/all_good_mate", nil)
+		handler.proxy(w, req)
+	}
+
+	if fw.requests != 3 {
+		t.Errorf("Expected 3 requests counted, but got %d", fw.requests)
+	}
+	if fw.connections != 0 {
+		t.Errorf("Expected no open connections, but got %d", fw.connections)
+	}
+	if fw.peakConnections != 1 {
+		t.Errorf("Expected peak of 1 connection, but got %d", fw.peakConnections)
+	}
+}
+
+func TestBackendBalancing(t *testing.T) {
+	fw := Flywheel{
+		config: &Config{
+			Vhosts:   map[string]string{"www.example.org": "www.backend.example.org"},
+			Backends: Backends{Port: 8080},
+		},
+	}
+	fw.backends.set([]string{"10.0.0.1:8080", "10.0.0.2:8080"})
+
+	if endpoint, _ := fw.Backend("www.example.org"); endpoint != "www.backend.example.org" {
+		t.Errorf("Expected the vhost to win over backends, but got %s", endpoint)
+	}
+
+	first, _ := fw.Backend("www.example.com")
+	second, release := fw.Backend("www.example.com")
+	if first == second {
+		t.Errorf("Expected round robin across backends, but got %s twice", first)
+	}
+	release()
+
+	fw.backends.mode = BalanceLeastConn
+	for i := 0; i < 3; i++ {
+		_, release := fw.Backend("www.example.com")
+		release()
+	}
+	// first is still busy
+	if endpoint, _ := fw.Backend("www.example.com"); endpoint != second {
+		t.Errorf("Expected least connections to pick %s, but got %s", second, endpoint)
+	}
+}
+
+func TestProxyForwardsHeaders(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	fw := Flywheel{
+		config: &Config{
+			Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		},
+	}
+	handler := NewHandler(&fw)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/all_good_mate?flywheel=start", nil)
+	req.Host = "www.example.org"
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "secret")
+	handler.proxy(w, req)
+
+	if received.Get("X-Forwarded-For") != "192.0.2.1" {
+		t.Errorf("Expected X-Forwarded-For 192.0.2.1, but got %q", received.Get("X-Forwarded-For"))
+	}
+	if received.Get("X-Forwarded-Host") != "www.example.org" {
+		t.Errorf("Expected X-Forwarded-Host www.example.org, but got %q", received.Get("X-Forwarded-Host"))
+	}
+	if received.Get("X-Forwarded-Proto") != "http" {
+		t.Errorf("Expected X-Forwarded-Proto http, but got %q", received.Get("X-Forwarded-Proto"))
+	}
+	if received.Get("X-Client-Hop") != "" {
+		t.Errorf("Expected hop-by-hop request headers to be dropped, but got %q", received.Get("X-Client-Hop"))
+	}
+	if w.Header().Get("Keep-Alive") != "" {
+		t.Errorf("Expected hop-by-hop response headers to be dropped, but got %q", w.Header().Get("Keep-Alive"))
+	}
+
+	// Behind a trusted proxy, its headers are kept
+	fw.config.TrustProxy = true
+	handler.proxy(httptest.NewRecorder(), req)
+
+	if received.Get("X-Forwarded-For") != "198.51.100.1, 192.0.2.1" {
+		t.Errorf("Expected X-Forwarded-For 198.51.100.1, 192.0.2.1, but got %q", received.Get("X-Forwarded-For"))
+	}
+	if received.Get("X-Forwarded-Proto") != "https" {
+		t.Errorf("Expected X-Forwarded-Proto https, but got %q", received.Get("X-Forwarded-Proto"))
+	}
+}
+
+func TestProxyForwardedHeadersNotHopByHop(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	fw := Flywheel{
+		config: &Config{
+			Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		},
+	}
+	handler := NewHandler(&fw)
+
+	// Clients can't have the headers of flywheel dropped by naming them
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Host = "www.example.org"
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Connection", "X-Forwarded-Proto, X-Forwarded-Host, X-Forwarded-For")
+	handler.proxy(httptest.NewRecorder(), req)
+
+	if received.Get("X-Forwarded-For") != "192.0.2.1" {
+		t.Errorf("Expected X-Forwarded-For 192.0.2.1, but got %q", received.Get("X-Forwarded-For"))
+	}
+	if received.Get("X-Forwarded-Host") != "www.example.org" {
+		t.Errorf("Expected X-Forwarded-Host www.example.org, but got %q", received.Get("X-Forwarded-Host"))
+	}
+	if received.Get("X-Forwarded-Proto") != "http" {
+		t.Errorf("Expected X-Forwarded-Proto http, but got %q", received.Get("X-Forwarded-Proto"))
+	}
+}
+
+func TestProxyTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	fw := Flywheel{
+		config: &Config{
+			Vhosts:   map[string]string{"slow.example.org": strings.TrimPrefix(server.URL, "http://")},
+			Timeouts: map[string]Duration{"slow.example.org": Duration(10 * time.Millisecond)},
+		},
+	}
+	handler := NewHandler(&fw)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/slow", nil)
+	req.Host = "slow.example.org"
+	handler.proxy(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expexted code %d, but got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	defer backend.Close()
+
+	fw := Flywheel{
+		config: &Config{
+			Endpoint: strings.TrimPrefix(backend.URL, "http://"),
+		},
+	}
+	handler := NewHandler(&fw)
+	front := httptest.NewServer(http.HandlerFunc(handler.proxy))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /live HTTP/1.1\r\nHost: www.example.org\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expexted code %d, but got %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	fmt.Fprint(conn, "ping\n")
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Errorf("Expected the tunnel to echo ping, but got %q (%v)", line, err)
+	}
+	if fw.tunnels.count() != 1 {
+		t.Errorf("Expected 1 open tunnel, but got %d", fw.tunnels.count())
+	}
+
+	fw.tunnels.closeAll()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("Expected the tunnel to be closed, but got %v", err)
+	}
+	if fw.tunnels.count() != 0 {
+		t.Errorf("Expected no open tunnels, but got %d", fw.tunnels.count())
+	}
+}
+
+func TestProxyHTTPSUpstream(t *testing.T) {
+	var path string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "flywheel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fw := Flywheel{
+		config: &Config{
+			Endpoint: server.URL + "/app",
+			Upstreams: map[string]UpstreamTLS{
+				DefaultUpstream: {CA: ca, ServerName: "example.com"},
+			},
+		},
+	}
+	handler := NewHandler(&fw)
+	handler.HTTPClient.Transport = &http.Transport{}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/all_good_mate", nil)
+	handler.proxy(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expexted code %d, but got %d", http.StatusOK, w.Code)
+	}
+	if path != "/app/all_good_mate" {
+		t.Errorf("Expected the path prefix to be added, but got %s", path)
+	}
+}
+
+func TestProxyH2CUpstream(t *testing.T) {
+	var proto string
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	backend.Config.Protocols = &http.Protocols{}
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+
+	fw := Flywheel{
+		config: &Config{
+			Endpoint: "h2c://" + strings.TrimPrefix(backend.URL, "http://"),
+		},
+	}
+	handler := NewHandler(&fw)
+	handler.HTTPClient.Transport = &http.Transport{}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/helloworld.Greeter/SayHello", strings.NewReader("\x00\x00\x00\x00\x00"))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	handler.proxy(w, req)
+
+	if proto != "HTTP/2.0" {
+		t.Errorf("Expected the backend to be called over HTTP/2, but got %s", proto)
+	}
+	if status := w.Result().Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("Expected the grpc-status trailer to be passed on, but got %q", status)
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeGRPCStatus(w, Pong{Status: STOPPED, StatusName: STOPPED.String()})
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expexted code %d, but got %d", http.StatusOK, w.Code)
+	}
+	if w.Header().Get("Grpc-Status") != "14" {
+		t.Errorf("Expected grpc-status UNAVAILABLE, but got %q", w.Header().Get("Grpc-Status"))
+	}
+	if w.Header().Get("Flywheel-Status") != "STOPPED" {
+		t.Errorf("Expected flywheel-status STOPPED, but got %q", w.Header().Get("Flywheel-Status"))
+	}
+}
+
+func TestHoldRequest(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+
+	fw := Flywheel{
+		config: &Config{
+			Endpoint: strings.TrimPrefix(backend.URL, "http://"),
+			Hold:     HoldConfig{Paths: []string{"/api"}, Timeout: Duration(5 * time.Second), MaxBody: 16},
+		},
+		pings: make(chan Ping),
+	}
+	go func() {
+		status := STOPPED
+		for ping := range fw.pings {
+			if ping.requestStart {
+				status = STARTING
+			} else if status == STARTING {
+				status = STARTED
+			}
+			ping.replyTo <- Pong{Status: status}
+		}
+	}()
+	defer close(fw.pings)
+	handler := NewHandler(&fw)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/other", strings.NewReader("hello"))
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expexted code %d, but got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/jobs", strings.NewReader("this body is too large"))
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expexted code %d, but got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/jobs", strings.NewReader("hello"))
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("Expexted the held request to be proxied, but got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestHolds(t *testing.T) {
+	fw := Flywheel{
+		config: &Config{
+			Hold: HoldConfig{Vhosts: []string{"ci.example.org"}, Paths: []string{"/api"}},
+		},
+	}
+	handler := NewHandler(&fw)
+
+	tests := []struct {
+		host  string
+		path  string
+		holds bool
+	}{
+		{"ci.example.org", "/", true},
+		{"CI.example.org:8080", "/", true},
+		{"www.example.org", "/api", true},
+		{"www.example.org", "/api/jobs", true},
+		{"www.example.org", "/apiary", false},
+		{"www.example.org", "/", false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.path, nil)
+		req.Host = test.host
+		if handler.holds(req) != test.holds {
+			t.Errorf("Expexted holds %v for %s%s, but got %v", test.holds, test.host, test.path, !test.holds)
+		}
+	}
+}
+
+func TestProxyRoutes(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "api %s", r.URL.Path)
+	}))
+	defer api.Close()
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "web %s", r.URL.Path)
+	}))
+	defer web.Close()
+
+	fw := Flywheel{
+		config: &Config{
+			Endpoint: strings.TrimPrefix(web.URL, "http://"),
+			Routes: []Route{
+				{Host: "*.example.org", Path: "/api", Backend: api.URL, Rewrite: "/v2"},
+				{HostRegex: `admin\.example\.(org|com)`, Cookies: map[string]string{"beta": "1"}, Backend: api.URL},
+				{Headers: map[string]string{"X-Tier": "api"}, Backend: api.URL},
+			},
+		},
+	}
+	for i := range fw.config.Routes {
+		if err := fw.config.Routes[i].compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := NewHandler(&fw)
+
+	tests := []struct {
+		host     string
+		path     string
+		header   string
+		cookie   string
+		expected string
+	}{
+		{"www.example.org", "/api/users", "", "", "api /v2/users"},
+		{"www.example.org:8080", "/api/users", "", "", "api /v2/users"},
+		{"www.example.org", "/apiary", "", "", "web /apiary"},
+		{"www.example.org", "/users", "", "", "web /users"},
+		{"www.example.com", "/api/users", "", "", "web /api/users"},
+		{"admin.example.com", "/users", "", "beta=1", "api /users"},
+		{"admin.example.com", "/users", "", "beta=0", "web /users"},
+		{"www.example.com", "/users", "api", "", "api /users"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", test.path, nil)
+		req.Host = test.host
+		if test.header != "" {
+			req.Header.Set("X-Tier", test.header)
+		}
+		if test.cookie != "" {
+			req.Header.Set("Cookie", test.cookie)
+		}
+		handler.proxy(w, req)
+
+		if w.Body.String() != test.expected {
+			t.Errorf("Expexted %q for %s%s, but got %q", test.expected, test.host, test.path, w.Body.String())
+		}
+	}
+}
+
+func TestProxyRewrite(t *testing.T) {
+	var backendHost string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v2/") {
+			w.Header().Set("Location", "/v2/next")
+			w.Header().Add("Set-Cookie", "sid=2; Path=/v2")
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		w.Header().Set("Location", "http://"+backendHost+"/app/next")
+		w.Header().Add("Set-Cookie", "sid=1; Domain=node1.internal.example.net; Path=/app; HttpOnly")
+		w.Header().Add("Set-Cookie", "theme=dark; Domain=example.com")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusFound)
+		fmt.Fprint(w, `<a href="http://node1.internal.example.net/x">x</a> <img src="//`+backendHost+`/y.png"> <a href="https://other.example.com/">z</a>`)
+	}))
+	defer backend.Close()
+	backendHost = strings.TrimPrefix(backend.URL, "http://")
+
+	fw := Flywheel{
+		config: &Config{
+			Endpoint:   backend.URL + "/app",
+			TrustProxy: true,
+			Rewrite: RewriteConfig{
+				Hostnames: []string{"*.internal.example.net"},
+				Headers:   true,
+				HTML:      true,
+			},
+		},
+	}
+	handler := NewHandler(&fw)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Host = "www.example.org"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	handler.proxy(w, req)
+
+	if location := w.Header().Get("Location"); location != "https://www.example.org/next" {
+		t.Errorf("Expexted the Location to be rewritten, but got %s", location)
+	}
+	cookies := w.Header()["Set-Cookie"]
+	if len(cookies) != 2 || cookies[0] != "sid=1; Path=/; HttpOnly" || cookies[1] != "theme=dark; Domain=example.com" {
+		t.Errorf("Expexted the backend cookie to be rewritten, but got %v", cookies)
+	}
+	expected := `<a href="https://www.example.org/x">x</a> <img src="//www.example.org/y.png"> <a href="https://other.example.com/">z</a>`
+	if w.Body.String() != expected {
+		t.Errorf("Expexted body %s, but got %s", expected, w.Body.String())
+	}
+
+	// Routed with a rewrite, the backend paths are mapped back
+	fw.config.Routes = []Route{{Path: "/api", Backend: backend.URL, Rewrite: "/v2"}}
+	if err := fw.config.Routes[0].compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/login", nil)
+	req.Host = "www.example.org"
+	handler.proxy(w, req)
+
+	if location := w.Header().Get("Location"); location != "/api/next" {
+		t.Errorf("Expexted the rewritten Location path to be mapped back, but got %s", location)
+	}
+	if cookie := w.Header().Get("Set-Cookie"); cookie != "sid=2; Path=/api" {
+		t.Errorf("Expexted the rewritten cookie path to be mapped back, but got %s", cookie)
+	}
+}
+
+func TestProxyEscapedPath(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.EscapedPath()
+	}))
+	defer server.Close()
+
+	for endpoint, expected := range map[string]string{
+		server.URL:          "/a%2Fb",
+		server.URL + "/app": "/app/a%2Fb",
+	} {
+		fw := Flywheel{
+			config: &Config{
+				Endpoint: endpoint,
+			},
+		}
+		handler := NewHandler(&fw)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/a%2Fb", nil)
+		handler.proxy(w, req)
+
+		if path != expected {
+			t.Errorf("Expexted the escaped path %s, but got %s", expected, path)
+		}
+	}
+}
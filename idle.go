@@ -0,0 +1,141 @@
+package flywheel
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// checkIdleStages - apply the idle stages reached by the current idle time.
+// Runs from Poll while STARTED, before the idle timeout stops everything.
+func (fw *Flywheel) checkIdleStages() {
+	idle := time.Since(fw.lastActive)
+
+	stage := fw.state.IdleStage
+	for stage < len(fw.config.IdleStages) && idle >= time.Duration(fw.config.IdleStages[stage].After) {
+		err := fw.applyIdleStage(&fw.config.IdleStages[stage])
+		if err != nil {
+			log.Printf("Error applying idle stage %s: %v", fw.config.IdleStages[stage].Name, err)
+			return
+		}
+		stage++
+
+		fw.stateLock.Lock()
+		fw.state.IdleStage = stage
+		fw.stateLock.Unlock()
+	}
+}
+
+// applyIdleStage - shrink the autoscaling groups of an idle stage. The
+// capacity from before the first stage is saved, so activity can restore it.
+func (fw *Flywheel) applyIdleStage(stage *IdleStage) error {
+	log.Printf("Idle for %v - entering idle stage %s", time.Duration(stage.After), stage.Name)
+
+	for groupName, size := range stage.AutoScaling {
+		group, err := fw.describeAutoScalingGroup(groupName)
+		if err != nil {
+			return err
+		}
+		if *group.DesiredCapacity <= size {
+			continue
+		}
+
+		fw.stateLock.Lock()
+		if _, ok := fw.state.IdleCapacity[groupName]; !ok {
+			if fw.state.IdleCapacity == nil {
+				fw.state.IdleCapacity = make(map[string]AutoScalingCapacity)
+			}
+			fw.state.IdleCapacity[groupName] = AutoScalingCapacity{
+				MinSize:         *group.MinSize,
+				MaxSize:         *group.MaxSize,
+				DesiredCapacity: *group.DesiredCapacity,
+			}
+		}
+		fw.stateLock.Unlock()
+
+		minSize := *group.MinSize
+		if minSize > size {
+			minSize = size
+		}
+
+		log.Printf("Shrinking autoscaling group %s to %d instances", groupName, size)
+		_, err = fw.autoscaling.UpdateAutoScalingGroup(
+			&autoscaling.UpdateAutoScalingGroupInput{
+				AutoScalingGroupName: group.AutoScalingGroupName,
+				MinSize:              aws.Int64(minSize),
+				DesiredCapacity:      aws.Int64(size),
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreIdleStages - activity after an idle stage, grow the autoscaling
+// groups back to their size from before the first stage. Each group is
+// forgotten once restored, and the stage once all of them are, so a failure
+// is retried by the next activity.
+func (fw *Flywheel) restoreIdleStages() error {
+	fw.stateLock.Lock()
+	capacities := make(map[string]AutoScalingCapacity)
+	for groupName, capacity := range fw.state.IdleCapacity {
+		capacities[groupName] = capacity
+	}
+	fw.stateLock.Unlock()
+
+	for groupName, capacity := range capacities {
+		log.Printf("Activity while idle, restoring autoscaling group %s to min/desired size of %d/%d",
+			groupName, capacity.MinSize, capacity.DesiredCapacity)
+		_, err := fw.autoscaling.UpdateAutoScalingGroup(
+			&autoscaling.UpdateAutoScalingGroupInput{
+				AutoScalingGroupName: aws.String(groupName),
+				MinSize:              aws.Int64(capacity.MinSize),
+				DesiredCapacity:      aws.Int64(capacity.DesiredCapacity),
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		fw.stateLock.Lock()
+		delete(fw.state.IdleCapacity, groupName)
+		fw.stateLock.Unlock()
+	}
+
+	fw.stateLock.Lock()
+	fw.state.IdleCapacity = nil
+	fw.state.IdleStage = 0
+	fw.stateLock.Unlock()
+	return nil
+}
+
+// forgetIdleStages - the groups are being powered down. Make sure the
+// capacity saved for the next start is the one from before the idle stages,
+// not the shrunk one.
+func (fw *Flywheel) forgetIdleStages() {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	for groupName, capacity := range fw.state.IdleCapacity {
+		if _, ok := fw.state.AutoScaling[groupName]; ok {
+			fw.state.AutoScaling[groupName] = capacity
+		}
+	}
+	fw.state.IdleCapacity = nil
+	fw.state.IdleStage = 0
+}
+
+// idleStage - name of the idle stage the environment is in, if any
+func (fw *Flywheel) idleStage() string {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	if fw.state.IdleStage == 0 || fw.state.IdleStage > len(fw.config.IdleStages) {
+		return ""
+	}
+	return fw.config.IdleStages[fw.state.IdleStage-1].Name
+}
@@ -0,0 +1,103 @@
+package flywheel
+
+import (
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// trackRequest - count a proxied request for load scaling. The returned
+// function has to be called once the request is complete.
+func (fw *Flywheel) trackRequest() func() {
+	atomic.AddUint64(&fw.requests, 1)
+	connections := atomic.AddInt64(&fw.connections, 1)
+	for {
+		peak := atomic.LoadInt64(&fw.peakConnections)
+		if connections <= peak || atomic.CompareAndSwapInt64(&fw.peakConnections, peak, connections) {
+			break
+		}
+	}
+
+	return func() {
+		atomic.AddInt64(&fw.connections, -1)
+	}
+}
+
+// checkLoad - adjust the desired capacity of the load scaled autoscaling
+// groups once per load-scaling-interval. Runs from Poll while STARTED.
+func (fw *Flywheel) checkLoad() {
+	interval := time.Duration(fw.config.LoadPeriod)
+	if time.Since(fw.lastScaled) < interval {
+		return
+	}
+
+	requests := atomic.SwapUint64(&fw.requests, 0)
+	peak := atomic.SwapInt64(&fw.peakConnections, atomic.LoadInt64(&fw.connections))
+	elapsed := time.Since(fw.lastScaled)
+	first := fw.lastScaled.IsZero()
+	fw.lastScaled = time.Now()
+
+	// Don't shrink the groups right after a start or an idle stage,
+	// before there was a chance to measure the load.
+	if first || fw.idleStage() != "" {
+		return
+	}
+
+	rate := float64(requests) / elapsed.Seconds()
+	for groupName, scaling := range fw.config.LoadScaling {
+		size := scaling.MinSize
+		if scaling.RequestRate > 0 {
+			size = maxInt64(size, int64(math.Ceil(rate/scaling.RequestRate)))
+		}
+		if scaling.Connections > 0 {
+			size = maxInt64(size, int64(math.Ceil(float64(peak)/float64(scaling.Connections))))
+		}
+		if size > scaling.MaxSize {
+			size = scaling.MaxSize
+		}
+
+		err := fw.setLoadCapacity(groupName, size, rate, peak)
+		if err != nil {
+			log.Printf("Error scaling autoscaling group %s on load: %v", groupName, err)
+		}
+	}
+}
+
+func (fw *Flywheel) setLoadCapacity(groupName string, size int64, rate float64, peak int64) error {
+	group, err := fw.describeAutoScalingGroup(groupName)
+	if err != nil {
+		return err
+	}
+
+	// Stay within the limits of the group itself
+	if size < *group.MinSize {
+		size = *group.MinSize
+	}
+	if size > *group.MaxSize {
+		size = *group.MaxSize
+	}
+	if size == *group.DesiredCapacity {
+		return nil
+	}
+
+	log.Printf("Load of %.2f requests/s and %d connections, scaling autoscaling group %s from %d to %d instances",
+		rate, peak, groupName, *group.DesiredCapacity, size)
+	_, err = fw.autoscaling.SetDesiredCapacity(
+		&autoscaling.SetDesiredCapacityInput{
+			AutoScalingGroupName: group.AutoScalingGroupName,
+			DesiredCapacity:      aws.Int64(size),
+		},
+	)
+	return err
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
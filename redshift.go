@@ -0,0 +1,112 @@
+package flywheel
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/redshift"
+)
+
+// redshiftStates maps Redshift cluster statuses to the EC2 instance states
+// used by the healthcheck.
+var redshiftStates = map[string]string{
+	"available": "running",
+	"creating":  "pending",
+	"resuming":  "pending",
+	"pausing":   "stopping",
+	"paused":    "stopped",
+}
+
+// Resume paused Redshift clusters. Clusters already available or resuming are
+// skipped, so a failed start can be retried.
+func (fw *Flywheel) resumeRedshift() error {
+	for _, clusterID := range fw.config.Redshift {
+		state, err := fw.redshiftState(clusterID)
+		if err != nil {
+			return err
+		}
+		if state == "running" || state == "pending" {
+			continue
+		}
+
+		log.Printf("Resuming redshift cluster %s", clusterID)
+		_, err = fw.redshift.ResumeCluster(
+			&redshift.ResumeClusterInput{
+				ClusterIdentifier: aws.String(clusterID),
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pause Redshift clusters. Compute is no longer billed while paused, only the
+// storage. Clusters already paused or pausing are skipped.
+func (fw *Flywheel) pauseRedshift() error {
+	for _, clusterID := range fw.config.Redshift {
+		state, err := fw.redshiftState(clusterID)
+		if err != nil {
+			return err
+		}
+		if state == "stopped" || state == "stopping" {
+			continue
+		}
+
+		log.Printf("Pausing redshift cluster %s", clusterID)
+		_, err = fw.redshift.PauseCluster(
+			&redshift.PauseClusterInput{
+				ClusterIdentifier: aws.String(clusterID),
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redshiftState - the EC2 instance state matching the status of a cluster
+func (fw *Flywheel) redshiftState(clusterID string) (string, error) {
+	resp, err := fw.redshift.DescribeClusters(
+		&redshift.DescribeClustersInput{
+			ClusterIdentifier: aws.String(clusterID),
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Clusters) == 0 {
+		return "", fmt.Errorf("Redshift cluster %s not found", clusterID)
+	}
+
+	status := aws.StringValue(resp.Clusters[0].ClusterStatus)
+	if state, ok := redshiftStates[status]; ok {
+		return state, nil
+	}
+	return status, nil
+}
+
+func (fw *Flywheel) checkRedshift(health map[string]int) error {
+	for _, clusterID := range fw.config.Redshift {
+		resp, err := fw.redshift.DescribeClusters(
+			&redshift.DescribeClustersInput{
+				ClusterIdentifier: aws.String(clusterID),
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, cluster := range resp.Clusters {
+			state, ok := redshiftStates[*cluster.ClusterStatus]
+			if !ok {
+				state = *cluster.ClusterStatus
+			}
+			health[state] = health[state] + 1
+		}
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package flywheel
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Stages of a released data volume. Releasing goes from snapshotting to
+// detaching to released, restoring from any of them to attaching.
+const (
+	VolumeSnapshotting = "snapshotting"
+	VolumeDetaching    = "detaching"
+	VolumeReleased     = "released"
+	VolumeAttaching    = "attaching"
+)
+
+// ReleasedVolume - a data volume of a long stopped instance, kept as a
+// snapshot until the next start
+type ReleasedVolume struct {
+	Device     string `json:"device"`
+	VolumeID   string `json:"volume-id"`
+	SnapshotID string `json:"snapshot-id"`
+	Stage      string `json:"stage"`
+	Zone       string `json:"availability-zone"`
+	VolumeType string `json:"volume-type,omitempty"`
+	Iops       int64  `json:"iops,omitempty"`
+	Throughput int64  `json:"throughput,omitempty"`
+	Delete     bool   `json:"delete-on-termination,omitempty"`
+}
+
+// releaseVolumes - snapshot the data volumes of the stopped instances. The
+// healthcheck detaches and deletes them once the snapshots are complete.
+func (fw *Flywheel) releaseVolumes() error {
+	resp, err := fw.ec2.DescribeInstances(
+		&ec2.DescribeInstancesInput{
+			InstanceIds: fw.config.AwsInstances(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			if *instance.State.Name != "stopped" {
+				return fmt.Errorf("Instance %s is %s, not releasing volumes", *instance.InstanceId, *instance.State.Name)
+			}
+
+			var volumeIds []*string
+			for _, mapping := range instance.BlockDeviceMappings {
+				if mapping.Ebs != nil && aws.StringValue(mapping.DeviceName) != aws.StringValue(instance.RootDeviceName) {
+					volumeIds = append(volumeIds, mapping.Ebs.VolumeId)
+				}
+			}
+			if len(volumeIds) == 0 {
+				continue
+			}
+
+			vResp, err := fw.ec2.DescribeVolumes(
+				&ec2.DescribeVolumesInput{
+					VolumeIds: volumeIds,
+				},
+			)
+			if err != nil {
+				return err
+			}
+
+			var volumes []ReleasedVolume
+			for _, volume := range vResp.Volumes {
+				released := ReleasedVolume{
+					VolumeID:   *volume.VolumeId,
+					Stage:      VolumeSnapshotting,
+					Zone:       aws.StringValue(volume.AvailabilityZone),
+					VolumeType: aws.StringValue(volume.VolumeType),
+					Iops:       aws.Int64Value(volume.Iops),
+					Throughput: aws.Int64Value(volume.Throughput),
+				}
+				for _, attachment := range volume.Attachments {
+					released.Device = aws.StringValue(attachment.Device)
+					released.Delete = aws.BoolValue(attachment.DeleteOnTermination)
+				}
+
+				log.Printf("Snapshotting volume %s (%s) of instance %s to release it", released.VolumeID, released.Device, *instance.InstanceId)
+				snapshot, err := fw.ec2.CreateSnapshot(
+					&ec2.CreateSnapshotInput{
+						VolumeId:    volume.VolumeId,
+						Description: aws.String(fmt.Sprintf("flywheel: %s of %s", released.Device, *instance.InstanceId)),
+					},
+				)
+				if err != nil {
+					return err
+				}
+				released.SnapshotID = *snapshot.SnapshotId
+				volumes = append(volumes, released)
+
+				// Record each snapshot as soon as it exists
+				fw.setReleasedVolumes(*instance.InstanceId, volumes)
+			}
+		}
+	}
+	return nil
+}
+
+// restoreVolumes - on start, recreate released volumes from their snapshots.
+// Instances with volumes to restore are started by the healthcheck once the
+// volumes are attached again.
+func (fw *Flywheel) restoreVolumes() error {
+	fw.stateLock.Lock()
+	released := make(map[string][]ReleasedVolume, len(fw.state.Volumes))
+	for instanceID, volumes := range fw.state.Volumes {
+		released[instanceID] = append([]ReleasedVolume(nil), volumes...)
+	}
+	fw.stateLock.Unlock()
+
+	if len(released) == 0 {
+		return nil
+	}
+
+	for instanceID, volumes := range released {
+		for i := range volumes {
+			volume := &volumes[i]
+			if volume.Stage == VolumeReleased {
+				err := fw.createFromSnapshot(instanceID, volume)
+				if err != nil {
+					return err
+				}
+			}
+
+			// Volumes not deleted yet are simply attached again
+			volume.Stage = VolumeAttaching
+			fw.setReleasedVolumes(instanceID, volumes)
+		}
+	}
+
+	fw.stateLock.Lock()
+	fw.state.Restoring = time.Now()
+	fw.stateLock.Unlock()
+	return nil
+}
+
+// createFromSnapshot - recreate a released volume in its availability zone
+func (fw *Flywheel) createFromSnapshot(instanceID string, volume *ReleasedVolume) error {
+	log.Printf("Restoring volume %s of instance %s from snapshot %s", volume.Device, instanceID, volume.SnapshotID)
+	input := &ec2.CreateVolumeInput{
+		SnapshotId:       aws.String(volume.SnapshotID),
+		AvailabilityZone: aws.String(volume.Zone),
+		VolumeType:       aws.String(volume.VolumeType),
+	}
+	if volume.Iops > 0 && volume.VolumeType != ec2.VolumeTypeGp2 {
+		input.Iops = aws.Int64(volume.Iops)
+	}
+	if volume.Throughput > 0 {
+		input.Throughput = aws.Int64(volume.Throughput)
+	}
+
+	created, err := fw.ec2.CreateVolume(input)
+	if err != nil {
+		return err
+	}
+	volume.VolumeID = *created.VolumeId
+	return nil
+}
+
+// restoringVolumes - instances waiting for their volumes, not to be started yet
+func (fw *Flywheel) restoringVolumes() map[string]bool {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	instances := make(map[string]bool)
+	for instanceID, volumes := range fw.state.Volumes {
+		for _, volume := range volumes {
+			if volume.Stage == VolumeAttaching {
+				instances[instanceID] = true
+			}
+		}
+	}
+	return instances
+}
+
+// restoringSince - when the volumes started being restored, for the status
+func (fw *Flywheel) restoringSince() time.Time {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	for _, volumes := range fw.state.Volumes {
+		for _, volume := range volumes {
+			if volume.Stage == VolumeAttaching {
+				return fw.state.Restoring
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// volumesReleased - check if the volumes were released, or are being released
+func (fw *Flywheel) volumesReleased() bool {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	return len(fw.state.Volumes) > 0
+}
+
+func (fw *Flywheel) setReleasedVolumes(instanceID string, volumes []ReleasedVolume) {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	if fw.state.Volumes == nil {
+		fw.state.Volumes = make(map[string][]ReleasedVolume)
+	}
+	if len(volumes) == 0 {
+		delete(fw.state.Volumes, instanceID)
+		return
+	}
+	fw.state.Volumes[instanceID] = append([]ReleasedVolume(nil), volumes...)
+}
+
+// updateReleasedVolumes - save the volumes of an instance, unless their
+// stages were changed since they were read
+func (fw *Flywheel) updateReleasedVolumes(instanceID string, previous, volumes []ReleasedVolume) bool {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	current := fw.state.Volumes[instanceID]
+	if len(current) != len(previous) {
+		return false
+	}
+	for i := range current {
+		if current[i].Stage != previous[i].Stage {
+			return false
+		}
+	}
+	fw.state.Volumes[instanceID] = volumes
+	return true
+}
+
+// checkReleasedVolumes - move the volumes of an instance along their stages.
+// Returns the state to report for the instance: restoring counts as pending.
+func (fw *Flywheel) checkReleasedVolumes(instance *ec2.Instance, state string) (string, error) {
+	fw.stateLock.Lock()
+	previous := fw.state.Volumes[*instance.InstanceId]
+	volumes := append([]ReleasedVolume(nil), previous...)
+	fw.stateLock.Unlock()
+
+	if len(volumes) == 0 {
+		return state, nil
+	}
+
+	restoring := false
+	for i := range volumes {
+		var err error
+		switch volumes[i].Stage {
+		case VolumeSnapshotting:
+			err = fw.detachSnapshotted(&volumes[i])
+		case VolumeDetaching:
+			err = fw.deleteDetached(&volumes[i])
+		case VolumeAttaching:
+			restoring = true
+			err = fw.attachRestored(*instance.InstanceId, &volumes[i])
+		}
+		if err != nil {
+			return state, err
+		}
+	}
+	if !fw.updateReleasedVolumes(*instance.InstanceId, previous, volumes) {
+		// A start changed the stages meanwhile, pick it up next time
+		return state, nil
+	}
+
+	if !restoring {
+		return state, nil
+	}
+
+	for _, volume := range volumes {
+		if volume.Stage == VolumeAttaching {
+			return "pending", nil
+		}
+	}
+
+	// Everything is attached again
+	log.Printf("Volumes of instance %s restored, starting it", *instance.InstanceId)
+	err := fw.startEC2Instances([]*string{instance.InstanceId})
+	if err != nil {
+		return state, err
+	}
+	for _, volume := range volumes {
+		fw.deleteSnapshot(volume.SnapshotID)
+	}
+	fw.setReleasedVolumes(*instance.InstanceId, nil)
+	return "pending", nil
+}
+
+// detachSnapshotted - detach a volume once its snapshot is complete
+func (fw *Flywheel) detachSnapshotted(volume *ReleasedVolume) error {
+	resp, err := fw.ec2.DescribeSnapshots(
+		&ec2.DescribeSnapshotsInput{
+			SnapshotIds: []*string{aws.String(volume.SnapshotID)},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if len(resp.Snapshots) == 0 {
+		return fmt.Errorf("Snapshot %s of volume %s not found", volume.SnapshotID, volume.VolumeID)
+	}
+
+	switch *resp.Snapshots[0].State {
+	case ec2.SnapshotStateCompleted:
+		log.Printf("Detaching volume %s to release it", volume.VolumeID)
+		_, err = fw.ec2.DetachVolume(
+			&ec2.DetachVolumeInput{
+				VolumeId: aws.String(volume.VolumeID),
+			},
+		)
+		if err != nil {
+			return err
+		}
+		volume.Stage = VolumeDetaching
+	case ec2.SnapshotStateError:
+		return fmt.Errorf("Snapshot %s of volume %s failed", volume.SnapshotID, volume.VolumeID)
+	}
+	return nil
+}
+
+// deleteDetached - delete a volume once it is detached
+func (fw *Flywheel) deleteDetached(volume *ReleasedVolume) error {
+	resp, err := fw.ec2.DescribeVolumes(
+		&ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(volume.VolumeID)},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if len(resp.Volumes) == 0 || *resp.Volumes[0].State != ec2.VolumeStateAvailable {
+		return nil
+	}
+
+	log.Printf("Deleting volume %s, kept as snapshot %s", volume.VolumeID, volume.SnapshotID)
+	_, err = fw.ec2.DeleteVolume(
+		&ec2.DeleteVolumeInput{
+			VolumeId: aws.String(volume.VolumeID),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	volume.Stage = VolumeReleased
+	return nil
+}
+
+// attachRestored - attach a volume to its instance once it is available. The
+// volume is done once attached.
+func (fw *Flywheel) attachRestored(instanceID string, volume *ReleasedVolume) error {
+	resp, err := fw.ec2.DescribeVolumes(
+		&ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(volume.VolumeID)},
+		},
+	)
+	if isAwsError(err, "InvalidVolume.NotFound") {
+		// Deleted by the healthcheck while the start was underway. The
+		// snapshot was complete by then, restore from it.
+		return fw.createFromSnapshot(instanceID, volume)
+	}
+	if err != nil {
+		return err
+	}
+	if len(resp.Volumes) == 0 {
+		return fmt.Errorf("Volume %s not found", volume.VolumeID)
+	}
+
+	switch *resp.Volumes[0].State {
+	case ec2.VolumeStateAvailable:
+		log.Printf("Attaching volume %s to instance %s as %s", volume.VolumeID, instanceID, volume.Device)
+		_, err = fw.ec2.AttachVolume(
+			&ec2.AttachVolumeInput{
+				VolumeId:   aws.String(volume.VolumeID),
+				InstanceId: aws.String(instanceID),
+				Device:     aws.String(volume.Device),
+			},
+		)
+		return err
+
+	case ec2.VolumeStateInUse:
+		for _, attachment := range resp.Volumes[0].Attachments {
+			if aws.StringValue(attachment.State) != ec2.VolumeAttachmentStateAttached {
+				return nil
+			}
+		}
+		if volume.Delete {
+			_, err = fw.ec2.ModifyInstanceAttribute(
+				&ec2.ModifyInstanceAttributeInput{
+					InstanceId: aws.String(instanceID),
+					BlockDeviceMappings: []*ec2.InstanceBlockDeviceMappingSpecification{
+						{
+							DeviceName: aws.String(volume.Device),
+							Ebs: &ec2.EbsInstanceBlockDeviceSpecification{
+								DeleteOnTermination: aws.Bool(true),
+							},
+						},
+					},
+				},
+			)
+			if err != nil {
+				return err
+			}
+		}
+		volume.Stage = ""
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package flywheel
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// absoluteURLs - the scheme and host of absolute and protocol relative URLs
+var absoluteURLs = regexp.MustCompile(`(?i)(https?:)?//[a-z0-9.-]+(:[0-9]+)?`)
+
+// rewriter - replaces the backend hostnames in a response with the public
+// hostname of the request, so the client doesn't leave flywheel
+type rewriter struct {
+	config  *RewriteConfig
+	backend string
+	public  string
+	scheme  string
+	prefix  string
+	route   *Route
+}
+
+// rewriter - the rewriter of the response to a request, proxied to the target
+// by the route if any. Nil when rewriting is off.
+func (handler *Handler) rewriter(r *http.Request, target *url.URL, route *Route) *rewriter {
+	config := &handler.Flywheel.config.Rewrite
+	if !config.Headers && !config.HTML {
+		return nil
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" && handler.Flywheel.config.TrustProxy {
+		scheme = proto
+	}
+	return &rewriter{
+		config:  config,
+		backend: strings.ToLower(target.Hostname()),
+		public:  r.Host,
+		scheme:  scheme,
+		prefix:  strings.TrimSuffix(target.Path, "/"),
+		route:   route,
+	}
+}
+
+// matchHost - check if a host is the backend proxied to, or one of the
+// configured backend hostnames
+func (rw *rewriter) matchHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if host == rw.backend {
+		return true
+	}
+	for _, pattern := range rw.config.Hostnames {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// publicPath - map a path of the backend back to the public one: remove the
+// path prefix of the backend target, and undo the rewrite of the route
+func (rw *rewriter) publicPath(p string) string {
+	if p == "" {
+		return p
+	}
+	if rest, ok := cutPathPrefix(p, rw.prefix); ok {
+		p = rest
+		if p == "" {
+			p = "/"
+		}
+	}
+	if rw.route != nil && rw.route.Rewrite != "" {
+		if rest, ok := cutPathPrefix(p, strings.TrimSuffix(rw.route.Rewrite, "/")); ok {
+			p = rw.route.Path
+			if rest != "" {
+				p = joinPath(rw.route.Path, rest)
+			}
+		}
+	}
+	return p
+}
+
+// rewriteURL - point a URL of the backend at the public hostname
+func (rw *rewriter) rewriteURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	if u.Host != "" {
+		if !rw.matchHost(u.Host) {
+			return raw
+		}
+		if u.Scheme != "" {
+			u.Scheme = rw.scheme
+		}
+		u.Host = rw.public
+	} else if !strings.HasPrefix(u.Path, "/") {
+		return raw
+	}
+
+	if p := rw.publicPath(u.Path); p != u.Path {
+		u.Path = p
+		u.RawPath = ""
+	}
+	return u.String()
+}
+
+// rewriteCookie - make a cookie for a backend hostname a cookie of the public
+// hostname, with the public path
+func (rw *rewriter) rewriteCookie(value string) string {
+	cookie, err := http.ParseSetCookie(value)
+	if err != nil {
+		return value
+	}
+
+	changed := false
+	if cookie.Domain != "" && rw.matchHost(strings.TrimPrefix(cookie.Domain, ".")) {
+		cookie.Domain = ""
+		changed = true
+	}
+	if p := rw.publicPath(cookie.Path); p != cookie.Path {
+		cookie.Path = p
+		changed = true
+	}
+	if !changed {
+		return value
+	}
+
+	rewritten := cookie.String()
+	for _, attr := range cookie.Unparsed {
+		rewritten += "; " + attr
+	}
+	return rewritten
+}
+
+// modifyResponse - rewrite the headers, and the body of HTML pages, of a
+// response from the backend
+func (rw *rewriter) modifyResponse(resp *http.Response) error {
+	if rw.config.Headers {
+		for _, name := range []string{"Location", "Content-Location"} {
+			if value := resp.Header.Get(name); value != "" {
+				resp.Header.Set(name, rw.rewriteURL(value))
+			}
+		}
+		cookies := resp.Header["Set-Cookie"]
+		for i, value := range cookies {
+			cookies[i] = rw.rewriteCookie(value)
+		}
+	}
+
+	if rw.config.HTML && isHTML(resp) {
+		return rw.rewriteBody(resp)
+	}
+	return nil
+}
+
+// rewriteBody - point the absolute links of a HTML page at the public
+// hostname. Compressed pages are left alone.
+func (rw *rewriter) rewriteBody(resp *http.Response) error {
+	if resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	body = absoluteURLs.ReplaceAllFunc(body, func(match []byte) []byte {
+		i := bytes.Index(match, []byte("//"))
+		if !rw.matchHost(string(match[i+2:])) {
+			return match
+		}
+		if i == 0 {
+			return []byte("//" + rw.public)
+		}
+		return []byte(rw.scheme + "://" + rw.public)
+	})
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// isHTML - check if a response is a HTML page
+func isHTML(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
@@ -0,0 +1,117 @@
+package flywheel
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Route - a routing rule. Requests matching all its conditions go to its
+// backend, with the path prefix optionally rewritten.
+type Route struct {
+	Host      string            `json:"host"`
+	HostRegex string            `json:"host-regex"`
+	Path      string            `json:"path-prefix"`
+	Headers   map[string]string `json:"headers"`
+	Cookies   map[string]string `json:"cookies"`
+	Backend   string            `json:"backend"`
+	Rewrite   string            `json:"rewrite"`
+
+	hostRegex *regexp.Regexp
+}
+
+// compile - check the rule, and compile its host regex
+func (route *Route) compile() error {
+	if _, err := ParseTarget(route.Backend); err != nil {
+		return err
+	}
+	if _, err := path.Match(strings.ToLower(route.Host), ""); err != nil {
+		return fmt.Errorf("Invalid host %s: %v", route.Host, err)
+	}
+	if route.HostRegex != "" {
+		re, err := regexp.Compile("^(?:" + route.HostRegex + ")$")
+		if err != nil {
+			return fmt.Errorf("Invalid host-regex %s: %v", route.HostRegex, err)
+		}
+		route.hostRegex = re
+	}
+	if route.Rewrite != "" && !strings.HasPrefix(route.Rewrite, "/") {
+		return fmt.Errorf("Rewrite %s doesn't start with /", route.Rewrite)
+	}
+	return nil
+}
+
+// matches - check the request against the conditions of the rule. The path
+// prefix matches whole path segments, and the port of the host is ignored.
+// Headers and cookies without a value only have to be present.
+func (route *Route) matches(r *http.Request) bool {
+	host := requestHostname(r)
+	if route.Host != "" {
+		if ok, _ := path.Match(strings.ToLower(route.Host), host); !ok {
+			return false
+		}
+	}
+	if route.hostRegex != nil && !route.hostRegex.MatchString(host) {
+		return false
+	}
+	if _, ok := cutPathPrefix(r.URL.Path, strings.TrimSuffix(route.Path, "/")); !ok {
+		return false
+	}
+
+	for name, value := range route.Headers {
+		actual := r.Header.Get(name)
+		if actual == "" || (value != "" && actual != value) {
+			return false
+		}
+	}
+	for name, value := range route.Cookies {
+		cookie, err := r.Cookie(name)
+		if err != nil || (value != "" && cookie.Value != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// rewrite - replace the matched path prefix with the rewrite, if any
+func (route *Route) rewrite(path string) string {
+	if route.Rewrite == "" {
+		return path
+	}
+	rest, _ := cutPathPrefix(path, strings.TrimSuffix(route.Path, "/"))
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return joinPath(route.Rewrite, rest)
+}
+
+// requestHostname - the lower case hostname of a request, without the port
+func requestHostname(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// cutPathPrefix - remove a prefix of whole path segments from a path. The
+// rest keeps its leading slash, and is empty if the path is the prefix.
+func cutPathPrefix(p, prefix string) (string, bool) {
+	if p != prefix && !strings.HasPrefix(p, prefix+"/") {
+		return p, false
+	}
+	return strings.TrimPrefix(p, prefix), true
+}
+
+// Route - the first routing rule matching a request, nil without one
+func (fw *Flywheel) Route(r *http.Request) *Route {
+	for i := range fw.config.Routes {
+		if fw.config.Routes[i].matches(r) {
+			return &fw.config.Routes[i]
+		}
+	}
+	return nil
+}
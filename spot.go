@@ -0,0 +1,203 @@
+package flywheel
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// CapacityError - EC2 has no capacity to start the instances, e.g. the spot
+// market for their instance type is exhausted. Usually temporary.
+type CapacityError struct {
+	InstanceIds []string
+	Reason      string
+}
+
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("No EC2 capacity available to start %v, try again later: %s", e.InstanceIds, e.Reason)
+}
+
+// capacityErrorCodes - EC2 API errors caused by a lack of capacity
+var capacityErrorCodes = map[string]bool{
+	"InsufficientCapacity":         true,
+	"InsufficientHostCapacity":     true,
+	"InsufficientInstanceCapacity": true,
+	"SpotMaxPriceTooLow":           true,
+	"MaxSpotInstanceCountExceeded": true,
+}
+
+// startEC2Instances - start instances, reporting a lack of capacity as a
+// CapacityError
+func (fw *Flywheel) startEC2Instances(instanceIds []*string) error {
+	if len(instanceIds) == 0 {
+		return nil
+	}
+
+	err := fw.checkSpotRequests(instanceIds)
+	if err != nil {
+		return err
+	}
+
+	_, err = fw.ec2.StartInstances(
+		&ec2.StartInstancesInput{
+			InstanceIds: instanceIds,
+		},
+	)
+	if aerr, ok := err.(awserr.Error); ok && capacityErrorCodes[aerr.Code()] {
+		return &CapacityError{
+			InstanceIds: aws.StringValueSlice(instanceIds),
+			Reason:      aerr.Message(),
+		}
+	}
+	return err
+}
+
+// checkSpotRequests - spot instances can only be started while their
+// persistent spot request is still open. Stopping the instance disables the
+// request, starting it enables it again, but a cancelled or closed request
+// can't be revived.
+func (fw *Flywheel) checkSpotRequests(instanceIds []*string) error {
+	resp, err := fw.ec2.DescribeInstances(
+		&ec2.DescribeInstancesInput{
+			InstanceIds: instanceIds,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	var requestIds []*string
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.SpotInstanceRequestId != nil {
+				requestIds = append(requestIds, instance.SpotInstanceRequestId)
+			}
+		}
+	}
+	if len(requestIds) == 0 {
+		return nil
+	}
+
+	sResp, err := fw.ec2.DescribeSpotInstanceRequests(
+		&ec2.DescribeSpotInstanceRequestsInput{
+			SpotInstanceRequestIds: requestIds,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, request := range sResp.SpotInstanceRequests {
+		switch *request.State {
+		case ec2.SpotInstanceStateOpen, ec2.SpotInstanceStateActive, ec2.SpotInstanceStateDisabled:
+			continue
+		}
+
+		reason := *request.State
+		if request.Status != nil && request.Status.Message != nil {
+			reason = *request.Status.Message
+		}
+		return fmt.Errorf("Spot request %s of instance %s is %s, the instance can't be started: %s",
+			*request.SpotInstanceRequestId, aws.StringValue(request.InstanceId), *request.State, reason)
+	}
+	return nil
+}
+
+// isSpotCapacityFailure - check if a failed scaling activity was caused by a
+// lack of spot capacity
+func isSpotCapacityFailure(activity *autoscaling.Activity) bool {
+	if *activity.StatusCode != autoscaling.ScalingActivityStatusCodeFailed || activity.StatusMessage == nil {
+		return false
+	}
+	message := strings.ToLower(*activity.StatusMessage)
+	return strings.Contains(message, "spot") &&
+		(strings.Contains(message, "capacity") || strings.Contains(message, "price"))
+}
+
+// onDemandFallback - switch an autoscaling group launching spot instances to
+// on-demand instances when its last launch failed for lack of spot capacity.
+// The spot/on-demand split is restored by restoreSpot.
+func (fw *Flywheel) onDemandFallback(group *autoscaling.Group) error {
+	groupName := *group.AutoScalingGroupName
+	if !fw.config.Spot.FallsBack(groupName) ||
+		group.MixedInstancesPolicy == nil || group.MixedInstancesPolicy.InstancesDistribution == nil {
+		return nil
+	}
+	distribution := group.MixedInstancesPolicy.InstancesDistribution
+	if aws.Int64Value(distribution.OnDemandPercentageAboveBaseCapacity) == 100 {
+		return nil
+	}
+
+	resp, err := fw.autoscaling.DescribeScalingActivities(
+		&autoscaling.DescribeScalingActivitiesInput{
+			AutoScalingGroupName: group.AutoScalingGroupName,
+			MaxRecords:           aws.Int64(1),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if len(resp.Activities) == 0 || !isSpotCapacityFailure(resp.Activities[0]) {
+		return nil
+	}
+
+	log.Printf("No spot capacity for autoscaling group %s, switching to on-demand instances: %s",
+		groupName, *resp.Activities[0].StatusMessage)
+	_, err = fw.autoscaling.UpdateAutoScalingGroup(
+		&autoscaling.UpdateAutoScalingGroupInput{
+			AutoScalingGroupName: group.AutoScalingGroupName,
+			MixedInstancesPolicy: &autoscaling.MixedInstancesPolicy{
+				InstancesDistribution: &autoscaling.InstancesDistribution{
+					OnDemandPercentageAboveBaseCapacity: aws.Int64(100),
+				},
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	fw.stateLock.Lock()
+	if fw.state.OnDemandPercentage == nil {
+		fw.state.OnDemandPercentage = make(map[string]int64)
+	}
+	fw.state.OnDemandPercentage[groupName] = aws.Int64Value(distribution.OnDemandPercentageAboveBaseCapacity)
+	fw.stateLock.Unlock()
+	return nil
+}
+
+// restoreSpot - go back to spot instances after an on-demand fallback, so the
+// next start tries spot capacity again
+func (fw *Flywheel) restoreSpot(groupName string) error {
+	fw.stateLock.Lock()
+	percentage, ok := fw.state.OnDemandPercentage[groupName]
+	fw.stateLock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	log.Printf("Restoring on-demand percentage of autoscaling group %s to %d", groupName, percentage)
+	_, err := fw.autoscaling.UpdateAutoScalingGroup(
+		&autoscaling.UpdateAutoScalingGroupInput{
+			AutoScalingGroupName: aws.String(groupName),
+			MixedInstancesPolicy: &autoscaling.MixedInstancesPolicy{
+				InstancesDistribution: &autoscaling.InstancesDistribution{
+					OnDemandPercentageAboveBaseCapacity: aws.Int64(percentage),
+				},
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	fw.stateLock.Lock()
+	delete(fw.state.OnDemandPercentage, groupName)
+	fw.stateLock.Unlock()
+	return nil
+}
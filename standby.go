@@ -0,0 +1,191 @@
+package flywheel
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Move the instances of an autoscale group into Standby and stop them. Standby
+// instances are not health checked, replaced or load balanced by the group, so
+// nothing fights the stop.
+func (fw *Flywheel) standbyAutoScaling() error {
+	for _, groupName := range fw.config.AutoScaling.Standby {
+		log.Printf("Moving autoscaling group %s to standby", groupName)
+
+		group, err := fw.describeAutoScalingGroup(groupName)
+		if err != nil {
+			return err
+		}
+
+		inService := []*string{}
+		instanceIds := []*string{}
+		for _, instance := range group.Instances {
+			if *instance.LifecycleState == autoscaling.LifecycleStateInService {
+				inService = append(inService, instance.InstanceId)
+			}
+			instanceIds = append(instanceIds, instance.InstanceId)
+		}
+
+		if len(inService) > 0 {
+			// Entering standby decrements the desired capacity, which
+			// can't go below the minimum size.
+			fw.saveCapacity(group)
+			_, err = fw.autoscaling.UpdateAutoScalingGroup(
+				&autoscaling.UpdateAutoScalingGroupInput{
+					AutoScalingGroupName: group.AutoScalingGroupName,
+					MinSize:              aws.Int64(0),
+				},
+			)
+			if err != nil {
+				return err
+			}
+
+			_, err = fw.autoscaling.EnterStandby(
+				&autoscaling.EnterStandbyInput{
+					AutoScalingGroupName:           group.AutoScalingGroupName,
+					InstanceIds:                    inService,
+					ShouldDecrementDesiredCapacity: aws.Bool(true),
+				},
+			)
+			if err != nil {
+				return err
+			}
+			fw.setStandby(groupName, aws.StringValueSlice(inService))
+			fw.persist()
+		}
+
+		err = fw.stopEC2Instances(instanceIds, fw.config.Hibernates(groupName))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Start the standby instances of an autoscale group.
+// The instances are moved out of standby by the healthcheck once they are all
+// running.
+func (fw *Flywheel) startStandbyAutoScaling() error {
+	for _, groupName := range fw.config.AutoScaling.Standby {
+		log.Printf("Starting standby autoscaling group %s", groupName)
+
+		group, err := fw.describeAutoScalingGroup(groupName)
+		if err != nil {
+			return err
+		}
+
+		instanceIds := []*string{}
+		for _, instance := range group.Instances {
+			instanceIds = append(instanceIds, instance.InstanceId)
+		}
+		err = fw.startEC2Instances(instanceIds)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fw *Flywheel) checkStandbyAutoScalingGroups(health map[string]int) error {
+	for _, groupName := range fw.config.AutoScaling.Standby {
+		group, err := fw.describeAutoScalingGroup(groupName)
+		if err != nil {
+			return err
+		}
+
+		// Only the instances moved to standby by flywheel are moved
+		// back, not the ones an operator put there
+		moved := make(map[string]bool)
+		for _, instanceID := range fw.standbyInstances(groupName) {
+			moved[instanceID] = true
+		}
+
+		standby := []*string{}
+		instanceIds := []*string{}
+		for _, instance := range group.Instances {
+			if *instance.LifecycleState == autoscaling.LifecycleStateStandby && moved[*instance.InstanceId] {
+				standby = append(standby, instance.InstanceId)
+			}
+			instanceIds = append(instanceIds, instance.InstanceId)
+		}
+		if len(instanceIds) == 0 {
+			continue
+		}
+
+		iResp, err := fw.ec2.DescribeInstances(
+			&ec2.DescribeInstancesInput{
+				InstanceIds: instanceIds,
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		running := true
+		for _, reservation := range iResp.Reservations {
+			for _, instance := range reservation.Instances {
+				state := *instance.State.Name
+				health[state] = health[state] + 1
+				running = running && state == "running"
+			}
+		}
+
+		// once all instances are running, put them back in service and
+		// restore the minimum size lowered by standbyAutoScaling
+		if running && len(standby) > 0 {
+			log.Printf("Moving autoscaling group %s out of standby", groupName)
+			_, err = fw.autoscaling.ExitStandby(
+				&autoscaling.ExitStandbyInput{
+					AutoScalingGroupName: group.AutoScalingGroupName,
+					InstanceIds:          standby,
+				},
+			)
+			if err != nil {
+				return err
+			}
+			fw.setStandby(groupName, nil)
+
+			if capacity, ok := fw.savedCapacity(groupName); ok {
+				_, err = fw.autoscaling.UpdateAutoScalingGroup(
+					&autoscaling.UpdateAutoScalingGroupInput{
+						AutoScalingGroupName: group.AutoScalingGroupName,
+						MinSize:              aws.Int64(capacity.MinSize),
+					},
+				)
+				if err != nil {
+					return err
+				}
+				fw.forgetCapacity(groupName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// standbyInstances - the instances of a group moved to standby by flywheel
+func (fw *Flywheel) standbyInstances(groupName string) []string {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	return append([]string(nil), fw.state.Standby[groupName]...)
+}
+
+func (fw *Flywheel) setStandby(groupName string, instanceIds []string) {
+	fw.stateLock.Lock()
+	defer fw.stateLock.Unlock()
+
+	if len(instanceIds) == 0 {
+		delete(fw.state.Standby, groupName)
+		return
+	}
+	if fw.state.Standby == nil {
+		fw.state.Standby = make(map[string][]string)
+	}
+	fw.state.Standby[groupName] = instanceIds
+}
@@ -0,0 +1,116 @@
+package flywheel
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+// deregisterTargets - take the instances out of their target groups before
+// they are stopped, so the load balancer stops health checking them. They are
+// registered again by the healthcheck after the next start.
+func (fw *Flywheel) deregisterTargets() error {
+	fw.stateLock.Lock()
+	fw.deregistered = true
+	fw.stateLock.Unlock()
+
+	for targetGroupArn, instanceIds := range fw.config.Targets {
+		log.Printf("Deregistering instances %v from target group %s", instanceIds, targetGroupArn)
+		_, err := fw.elbv2.DeregisterTargets(
+			&elbv2.DeregisterTargetsInput{
+				TargetGroupArn: aws.String(targetGroupArn),
+				Targets:        targetDescriptions(instanceIds),
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerTargets - let the healthcheck register the instances in their
+// target groups again, once started or when stopping failed
+func (fw *Flywheel) registerTargets() {
+	fw.stateLock.Lock()
+	fw.deregistered = false
+	fw.stateLock.Unlock()
+}
+
+// checkTargetGroups - once the instances run, register them in their target
+// groups. While starting, an instance counts as running once its target is
+// healthy. Targets failing health checks once started don't change the status.
+func (fw *Flywheel) checkTargetGroups(health map[string]int) error {
+	if len(fw.config.Targets) == 0 {
+		return nil
+	}
+
+	// Stopping, the targets are draining
+	fw.stateLock.Lock()
+	deregistered := fw.deregistered
+	fw.stateLock.Unlock()
+	if deregistered {
+		return nil
+	}
+	starting := fw.checked != STARTED
+
+	instances, err := fw.runningInstances()
+	if err != nil || instances == nil {
+		return err
+	}
+
+	for targetGroupArn, instanceIds := range fw.config.Targets {
+		resp, err := fw.elbv2.DescribeTargetHealth(
+			&elbv2.DescribeTargetHealthInput{
+				TargetGroupArn: aws.String(targetGroupArn),
+				Targets:        targetDescriptions(instanceIds),
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		var unregistered []string
+		for _, target := range resp.TargetHealthDescriptions {
+			state := aws.StringValue(target.TargetHealth.State)
+			switch state {
+			case elbv2.TargetHealthStateEnumHealthy, elbv2.TargetHealthStateEnumUnavailable:
+				// Unavailable means health checks are disabled
+				health["running"]++
+			case elbv2.TargetHealthStateEnumUnused, elbv2.TargetHealthStateEnumDraining:
+				unregistered = append(unregistered, aws.StringValue(target.Target.Id))
+				if starting {
+					health["pending"]++
+				}
+			default:
+				if starting {
+					health["pending"]++
+				}
+			}
+		}
+		if len(unregistered) == 0 {
+			continue
+		}
+
+		log.Printf("Registering instances %v in target group %s", unregistered, targetGroupArn)
+		_, err = fw.elbv2.RegisterTargets(
+			&elbv2.RegisterTargetsInput{
+				TargetGroupArn: aws.String(targetGroupArn),
+				Targets:        targetDescriptions(unregistered),
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func targetDescriptions(instanceIds []string) []*elbv2.TargetDescription {
+	targets := make([]*elbv2.TargetDescription, len(instanceIds))
+	for i := range instanceIds {
+		targets[i] = &elbv2.TargetDescription{Id: aws.String(instanceIds[i])}
+	}
+	return targets
+}
@@ -0,0 +1,106 @@
+package flywheel
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// TCPRetryInterval - how often a held connection checks whether the
+// environment has started and its backend accepts connections
+const TCPRetryInterval = time.Second
+
+// TCPProxy - forwards the connections of a listener to a backend, starting
+// the environment first if needed. Open connections count as activity.
+type TCPProxy struct {
+	handler *Handler
+	backend string
+	timeout time.Duration
+}
+
+// NewTCPProxy - create a TCP proxy to a backend host:port
+func NewTCPProxy(handler *Handler, backend string) *TCPProxy {
+	return &TCPProxy{
+		handler: handler,
+		backend: backend,
+		timeout: time.Duration(handler.Flywheel.config.TCPTimeout),
+	}
+}
+
+// Serve - accept connections until the listener is closed
+func (p *TCPProxy) Serve(sock net.Listener) error {
+	for {
+		conn, err := sock.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *TCPProxy) handle(conn net.Conn) {
+	defer p.handler.Flywheel.trackRequest()()
+
+	client := p.handler.Flywheel.tunnels.add(conn)
+	defer client.Close()
+
+	backend, err := p.connect()
+	if err != nil {
+		log.Printf("[%s] tcp %s: %v", conn.RemoteAddr(), p.backend, err)
+		return
+	}
+	defer backend.Close()
+	log.Printf("[%s] tcp %s connected", conn.RemoteAddr(), p.backend)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(backend, client)
+		// Let the backend know the client is done sending
+		if tcp, ok := backend.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		} else {
+			backend.Close()
+		}
+		close(done)
+	}()
+	io.Copy(client, backend)
+	client.Close()
+	<-done
+}
+
+// connect - start the environment if it is stopped, and connect to the
+// backend once it is started and accepts connections
+func (p *TCPProxy) connect() (net.Conn, error) {
+	deadline := time.Now().Add(p.timeout)
+	var err error
+
+	for time.Now().Before(deadline) {
+		pong := p.handler.sendPing("")
+		if pong.Status == STOPPED {
+			pong = p.handler.sendPing("start")
+		}
+		if pong.Err != nil {
+			return nil, pong.Err
+		}
+
+		if pong.Status == STARTED {
+			var backend net.Conn
+			backend, err = net.DialTimeout("tcp", p.backend, time.Until(deadline))
+			if err == nil {
+				return backend, nil
+			}
+		}
+		wait := time.Until(deadline)
+		if wait > TCPRetryInterval {
+			wait = TCPRetryInterval
+		}
+		time.Sleep(wait)
+	}
+
+	if err == nil {
+		err = fmt.Errorf("Environment did not start within %v", p.timeout)
+	}
+	return nil, err
+}
@@ -0,0 +1,150 @@
+package flywheel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoServer - a backend sending back what it receives
+func echoServer(t *testing.T) net.Listener {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return backend
+}
+
+// tcpFrontend - a TCP proxy listener to the backend
+func tcpFrontend(t *testing.T, fw *Flywheel, backend string) net.Listener {
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewTCPProxy(NewHandler(fw), backend).Serve(front)
+	return front
+}
+
+func TestTCPProxy(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	fw := &Flywheel{
+		config: &Config{TCPTimeout: Duration(time.Second)},
+		pings:  make(chan Ping),
+		status: STARTED,
+	}
+	go func() {
+		for ping := range fw.pings {
+			fw.RecvPing(&ping)
+		}
+	}()
+	defer close(fw.pings)
+
+	front := tcpFrontend(t, fw, backend.Addr().String())
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "ping\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Errorf("Expected the backend to echo ping, but got %q (%v)", line, err)
+	}
+	if fw.tunnels.count() != 1 {
+		t.Errorf("Expected the session to count as activity, but got %d open", fw.tunnels.count())
+	}
+}
+
+func TestTCPProxyStartsEnvironment(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	fw := &Flywheel{
+		config: &Config{TCPTimeout: Duration(5 * time.Second)},
+		pings:  make(chan Ping),
+	}
+	started := make(chan bool, 1)
+	go func() {
+		status := STOPPED
+		for ping := range fw.pings {
+			if ping.requestStart {
+				status = STARTING
+				started <- true
+			} else if status == STARTING {
+				status = STARTED
+			}
+			ping.replyTo <- Pong{Status: status}
+		}
+	}()
+	defer close(fw.pings)
+
+	front := tcpFrontend(t, fw, backend.Addr().String())
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "ping\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Errorf("Expected the held connection to reach the backend once started, but got %q (%v)", line, err)
+	}
+	select {
+	case <-started:
+	default:
+		t.Errorf("Expected the connection to start the environment")
+	}
+}
+
+func TestTCPProxyStartTimeout(t *testing.T) {
+	fw := &Flywheel{
+		config: &Config{TCPTimeout: Duration(50 * time.Millisecond)},
+		pings:  make(chan Ping),
+	}
+	go func() {
+		for ping := range fw.pings {
+			ping.replyTo <- Pong{Status: STARTING}
+		}
+	}()
+	defer close(fw.pings)
+
+	front := tcpFrontend(t, fw, "127.0.0.1:1")
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed after the start timeout, but got %v", err)
+	}
+	if fw.tunnels.count() != 0 {
+		t.Errorf("Expected no open sessions after the timeout, but got %d", fw.tunnels.count())
+	}
+}
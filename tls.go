@@ -0,0 +1,156 @@
+package flywheel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCertificate - name of the certificate used for hostnames without
+// their own
+const DefaultCertificate = "default"
+
+// CertStore - the TLS certificates by hostname, reloaded when their files
+// are rotated
+type CertStore struct {
+	lock  sync.RWMutex
+	files map[string]CertificateFiles
+	certs map[string]*loadedCert
+}
+
+type loadedCert struct {
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+// NewCertStore - load the configured certificates
+func NewCertStore(config *TLSConfig) (*CertStore, error) {
+	store := &CertStore{
+		files: make(map[string]CertificateFiles),
+		certs: make(map[string]*loadedCert),
+	}
+	for hostname, files := range config.Certificates {
+		hostname = strings.ToLower(hostname)
+		store.files[hostname] = files
+
+		loaded, err := loadCertificate(files)
+		if err != nil {
+			return nil, fmt.Errorf("Certificate for %s: %v", hostname, err)
+		}
+		store.certs[hostname] = loaded
+	}
+	return store, nil
+}
+
+func loadCertificate(files CertificateFiles) (*loadedCert, error) {
+	modified, err := certModified(files)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &loadedCert{cert: &cert, modified: modified}, nil
+}
+
+// certModified - the latest modification time of the certificate files
+func certModified(files CertificateFiles) (time.Time, error) {
+	var modified time.Time
+	for _, name := range []string{files.Cert, files.Key} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return modified, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+// GetCertificate - pick the certificate of the SNI hostname, falling back to
+// the default certificate
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if loaded, ok := s.certs[strings.ToLower(hello.ServerName)]; ok {
+		return loaded.cert, nil
+	}
+	if loaded, ok := s.certs[DefaultCertificate]; ok {
+		return loaded.cert, nil
+	}
+	return nil, fmt.Errorf("No certificate for %q", hello.ServerName)
+}
+
+// Reload - load the certificates whose files changed. A certificate which
+// fails to load is logged, and the previous one kept.
+func (s *CertStore) Reload() {
+	for hostname, files := range s.files {
+		modified, err := certModified(files)
+		if err != nil {
+			log.Printf("Unable to check certificate for %s: %v", hostname, err)
+			continue
+		}
+
+		s.lock.RLock()
+		current := s.certs[hostname]
+		s.lock.RUnlock()
+		if !modified.After(current.modified) {
+			continue
+		}
+
+		loaded, err := loadCertificate(files)
+		if err != nil {
+			log.Printf("Unable to reload certificate for %s: %v", hostname, err)
+			continue
+		}
+		log.Printf("Reloaded certificate for %s", hostname)
+
+		s.lock.Lock()
+		s.certs[hostname] = loaded
+		s.lock.Unlock()
+	}
+}
+
+// Watch - reload rotated certificates periodically. Never returns.
+func (s *CertStore) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		s.Reload()
+	}
+}
+
+// TLSConfig - TLS settings for a listener serving the certificates
+func (s *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// RedirectHandler - send plain HTTP requests to the same URL over HTTPS, on
+// the port of the TLS listener
+func RedirectHandler(tlsListen string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsListen)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
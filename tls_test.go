@@ -0,0 +1,126 @@
+package flywheel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate - write a self signed certificate for a hostname
+func writeCertificate(t *testing.T, dir, hostname string) CertificateFiles {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := CertificateFiles{
+		Cert: filepath.Join(dir, hostname+".crt"),
+		Key:  filepath.Join(dir, hostname+".key"),
+	}
+	err = ioutil.WriteFile(files.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(files.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func certName(t *testing.T, store *CertStore, serverName string) string {
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flywheel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vhost := writeCertificate(t, dir, "www.example.org")
+	store, err := NewCertStore(&TLSConfig{
+		Certificates: map[string]CertificateFiles{
+			"www.example.org":  vhost,
+			DefaultCertificate: writeCertificate(t, dir, "default.example.org"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name := certName(t, store, "WWW.example.org"); name != "www.example.org" {
+		t.Errorf("Expected the vhost certificate, but got %s", name)
+	}
+	if name := certName(t, store, "other.example.org"); name != "default.example.org" {
+		t.Errorf("Expected the default certificate, but got %s", name)
+	}
+
+	// Rotate the vhost certificate
+	rotated := writeCertificate(t, dir, "rotated.example.org")
+	os.Rename(rotated.Cert, vhost.Cert)
+	os.Rename(rotated.Key, vhost.Key)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(vhost.Cert, future, future)
+	store.Reload()
+
+	if name := certName(t, store, "www.example.org"); name != "rotated.example.org" {
+		t.Errorf("Expected the rotated certificate, but got %s", name)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	testTable := []struct {
+		listen, host, location string
+	}{
+		{"0.0.0.0:443", "www.example.org", "https://www.example.org/path?q=1"},
+		{"0.0.0.0:443", "www.example.org:80", "https://www.example.org/path?q=1"},
+		{"0.0.0.0:8443", "www.example.org:8080", "https://www.example.org:8443/path?q=1"},
+	}
+
+	for _, tt := range testTable {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/path?q=1", nil)
+		req.Host = tt.host
+		RedirectHandler(tt.listen).ServeHTTP(w, req)
+
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tt.location {
+			t.Errorf("Expected redirect to %s, but got %d %s", tt.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
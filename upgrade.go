@@ -0,0 +1,113 @@
+package flywheel
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// isUpgrade - check if a request asks to switch protocols, e.g. WebSockets
+func isUpgrade(r *http.Request) bool {
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWriter - keeps track of the client connection once the backend
+// agrees to switch protocols and the ReverseProxy tunnels it
+type upgradeWriter struct {
+	http.ResponseWriter
+	fw *Flywheel
+}
+
+// Hijack - take over the client connection, registering it as a tunnel
+func (w *upgradeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Connection can't be upgraded")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return w.fw.tunnels.add(conn), rw, nil
+}
+
+// Unwrap - gives the ReverseProxy access to flushing
+func (w *upgradeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// tunnels - the upgraded connections currently open
+type tunnels struct {
+	lock  sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func (t *tunnels) add(conn net.Conn) net.Conn {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]bool)
+	}
+	tunnel := &tunnelConn{Conn: conn, tunnels: t}
+	t.conns[tunnel] = true
+	return tunnel
+}
+
+func (t *tunnels) remove(conn net.Conn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.conns, conn)
+}
+
+// count - number of open tunnels
+func (t *tunnels) count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return len(t.conns)
+}
+
+// closeAll - close the open tunnels. The ReverseProxy then closes the backend
+// side of each.
+func (t *tunnels) closeAll() {
+	t.lock.Lock()
+	conns := make([]net.Conn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.lock.Unlock()
+
+	if len(conns) > 0 {
+		log.Printf("Closing %d upgraded connections", len(conns))
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// tunnelConn - a client connection which unregisters itself when closed
+type tunnelConn struct {
+	net.Conn
+	tunnels *tunnels
+	once    sync.Once
+}
+
+func (c *tunnelConn) Close() error {
+	c.once.Do(func() {
+		c.tunnels.remove(c)
+	})
+	return c.Conn.Close()
+}
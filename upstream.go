@@ -0,0 +1,125 @@
+package flywheel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultUpstream - name of the upstream TLS settings used for HTTPS backends
+// without their own
+const DefaultUpstream = "default"
+
+// ParseTarget - parse an endpoint or vhost target. Targets are a hostname and
+// optional port, or a URL with a http, https or h2c (HTTP/2 without TLS)
+// scheme and optional path prefix.
+func ParseTarget(target string) (*url.URL, error) {
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "h2c" {
+		return nil, fmt.Errorf("Unsupported scheme %s in %s", u.Scheme, target)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("No host in %s", target)
+	}
+	return u, nil
+}
+
+// joinPath - prefix the path of a request with the path of its target
+func joinPath(prefix, path string) string {
+	if prefix == "" || prefix == "/" {
+		return path
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// upstreamTransport - the transport to a backend: HTTP/2 without TLS for h2c
+// backends, and with their TLS settings for HTTPS backends. Transports are
+// built once per backend.
+func (handler *Handler) upstreamTransport(target *url.URL) (http.RoundTripper, error) {
+	base := handler.HTTPClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	transport, ok := base.(*http.Transport)
+	if !ok || target.Scheme == "http" {
+		return base, nil
+	}
+
+	var settings UpstreamTLS
+	if target.Scheme == "https" {
+		settings, ok = handler.Flywheel.config.Upstreams[target.Host]
+		if !ok {
+			settings, ok = handler.Flywheel.config.Upstreams[DefaultUpstream]
+		}
+		if !ok && transport.ForceAttemptHTTP2 {
+			return base, nil
+		}
+	}
+
+	handler.transportLock.Lock()
+	defer handler.transportLock.Unlock()
+
+	key := target.Scheme + "://" + target.Host
+	if cached, ok := handler.transports[key]; ok {
+		return cached, nil
+	}
+
+	transport = transport.Clone()
+	if target.Scheme == "h2c" {
+		// Prior knowledge HTTP/2, e.g. for gRPC backends
+		protocols := &http.Protocols{}
+		protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols = protocols
+	} else {
+		tlsConfig, err := settings.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("TLS settings for %s: %v", target.Host, err)
+		}
+		transport.TLSClientConfig = tlsConfig
+		transport.ForceAttemptHTTP2 = true
+	}
+
+	if handler.transports == nil {
+		handler.transports = make(map[string]http.RoundTripper)
+	}
+	handler.transports[key] = transport
+	return transport, nil
+}
+
+// tlsConfig - client TLS settings for a backend
+func (u *UpstreamTLS) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         u.ServerName,
+		InsecureSkipVerify: u.Insecure,
+	}
+
+	if u.CA != "" {
+		pem, err := ioutil.ReadFile(u.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in %s", u.CA)
+		}
+	}
+
+	if u.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(u.Cert, u.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,149 @@
+package flywheel
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// Scale an autoscale group in to its warm pool. The warm pool is set to keep
+// stopped instances and reuse instances on scale in, so the running instances
+// are stopped and parked in the pool instead of being terminated. The pool is
+// sized for the running instances only, and emptied again on start.
+func (fw *Flywheel) parkAutoScaling() error {
+	var zero int64
+	for _, groupName := range fw.config.AutoScaling.WarmPool {
+		log.Printf("Parking autoscaling group %s in its warm pool", groupName)
+
+		group, err := fw.describeAutoScalingGroup(groupName)
+		if err != nil {
+			return err
+		}
+
+		// Don't overwrite the saved capacity with zeros, or shrink the
+		// pool, if the group was already parked.
+		if *group.DesiredCapacity > 0 {
+			fw.saveCapacity(group)
+
+			err = fw.putWarmPool(groupName, *group.DesiredCapacity, *group.DesiredCapacity)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = fw.restoreSpot(groupName)
+		if err != nil {
+			return err
+		}
+
+		_, err = fw.autoscaling.UpdateAutoScalingGroup(
+			&autoscaling.UpdateAutoScalingGroupInput{
+				AutoScalingGroupName: group.AutoScalingGroupName,
+				MinSize:              &zero,
+				DesiredCapacity:      &zero,
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore the size of an autoscale group parked in its warm pool. The group
+// takes the stopped instances from the pool and starts them.
+func (fw *Flywheel) unparkAutoScaling() error {
+	for _, groupName := range fw.config.AutoScaling.WarmPool {
+		capacity, ok := fw.savedCapacity(groupName)
+		if !ok {
+			log.Printf("No capacity recorded for autoscaling group %s, skipping restore", groupName)
+			continue
+		}
+
+		log.Printf("Restoring autoscaling group %s from its warm pool to min/desired size of %d/%d",
+			groupName, capacity.MinSize, capacity.DesiredCapacity)
+		_, err := fw.autoscaling.UpdateAutoScalingGroup(
+			&autoscaling.UpdateAutoScalingGroupInput{
+				AutoScalingGroupName: aws.String(groupName),
+				MinSize:              aws.Int64(capacity.MinSize),
+				DesiredCapacity:      aws.Int64(capacity.DesiredCapacity),
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		// The instances leave the pool for the group, don't let the
+		// pool launch more in their place
+		err = fw.putWarmPool(groupName, 0, capacity.DesiredCapacity)
+		if err != nil {
+			return err
+		}
+		fw.forgetCapacity(groupName)
+	}
+	return nil
+}
+
+// putWarmPool - size the warm pool of stopped instances of a group. The pool
+// keeps minSize instances, or prepared minus the desired capacity of the
+// group if that is more.
+func (fw *Flywheel) putWarmPool(groupName string, minSize int64, prepared int64) error {
+	_, err := fw.autoscaling.PutWarmPool(
+		&autoscaling.PutWarmPoolInput{
+			AutoScalingGroupName:     aws.String(groupName),
+			PoolState:                aws.String(autoscaling.WarmPoolStateStopped),
+			MinSize:                  aws.Int64(minSize),
+			MaxGroupPreparedCapacity: aws.Int64(prepared),
+			InstanceReusePolicy: &autoscaling.InstanceReusePolicy{
+				ReuseOnScaleIn: aws.Bool(true),
+			},
+		},
+	)
+	return err
+}
+
+func (fw *Flywheel) checkWarmPoolAutoScalingGroups(health map[string]int) error {
+	for _, groupName := range fw.config.AutoScaling.WarmPool {
+		group, err := fw.describeAutoScalingGroup(groupName)
+		if err != nil {
+			return err
+		}
+
+		if *group.DesiredCapacity > 0 {
+			if countGroupInstances(health, group, fw.checked == STARTED) {
+				err = fw.onDemandFallback(group)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// Parked: instances still in the group are on their way to the
+		// pool, otherwise the pool decides if the group is stopped.
+		if len(group.Instances) > 0 {
+			for _, instance := range group.Instances {
+				state := lifecycleState(instance)
+				health[state] = health[state] + 1
+			}
+			continue
+		}
+
+		resp, err := fw.autoscaling.DescribeWarmPool(
+			&autoscaling.DescribeWarmPoolInput{
+				AutoScalingGroupName: group.AutoScalingGroupName,
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		health["stopped"]++
+		for _, instance := range resp.Instances {
+			state := lifecycleState(instance)
+			health[state] = health[state] + 1
+		}
+	}
+	return nil
+}